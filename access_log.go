@@ -0,0 +1,394 @@
+// 此文件定义访问日志中间件，依据Base里捕获的请求/返回内容输出访问日志
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessLogEntry 一次请求对应的访问日志
+type AccessLogEntry struct {
+	Time    time.Time     `json:"time"`
+	Method  string        `json:"method"`
+	Path    string        `json:"path"`
+	Remote  string        `json:"remote,omitempty"`
+	Status  int           `json:"status"`
+	Latency time.Duration `json:"latency"` // 纳秒
+	TraceID string        `json:"trace_id,omitempty"`
+	Ret     Code          `json:"ret"`
+	Req     string        `json:"req,omitempty"`
+	Resp    string        `json:"resp,omitempty"`
+}
+
+// AccessLogSink 访问日志输出目标
+type AccessLogSink interface {
+	WriteAccessLog(*AccessLogEntry)
+}
+
+// AccessLogSinkFunc 将普通函数适配为AccessLogSink
+type AccessLogSinkFunc func(*AccessLogEntry)
+
+func (f AccessLogSinkFunc) WriteAccessLog(entry *AccessLogEntry) {
+	f(entry)
+}
+
+// AccessLogConf 访问日志配置
+type AccessLogConf struct {
+	Sink       AccessLogSink // 为空时输出到GetLogger()
+	MaxBodyLen int           // req/resp超过此长度会被截断，<=0表示不截断
+	MaskFields []string      // 需要脱敏的json字段名，不区分大小写
+	MaskValue  string        // 脱敏后的值，为空时使用"***"
+}
+
+// DefaultAccessLogConf 未指定配置时使用
+var DefaultAccessLogConf = &AccessLogConf{
+	MaxBodyLen: 1024,
+	MaskFields: []string{"password", "passwd", "token", "secret"},
+}
+
+type loggerAccessLogSink struct{}
+
+func (loggerAccessLogSink) WriteAccessLog(entry *AccessLogEntry) {
+	l := GetLogger()
+	if entry.TraceID != "" {
+		l = l.With("trace_id", entry.TraceID)
+	}
+	l.Info("access",
+		"method", entry.Method,
+		"path", entry.Path,
+		"remote", entry.Remote,
+		"status", entry.Status,
+		"latency", entry.Latency,
+		"ret", int(entry.Ret),
+		"req", entry.Req,
+		"resp", entry.Resp,
+	)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// Unwrap 供http.ResponseController使用
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wrap 只暴露底层writer实现了的http.Flusher, http.Hijacker, http.Pusher，
+// 使handler里的类型断言结果与未包装时一致
+func (w *statusWriter) wrap() http.ResponseWriter {
+	_, f := w.ResponseWriter.(http.Flusher)
+	_, h := w.ResponseWriter.(http.Hijacker)
+	_, p := w.ResponseWriter.(http.Pusher)
+
+	switch {
+	case f && h && p:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	case f && h:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case f && p:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	case h && p:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	case f:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, w}
+	case h:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, w}
+	case p:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, w}
+	}
+	return struct{ http.ResponseWriter }{w}
+}
+
+// AccessLog 包装handler，每次请求新建一个controller，handler返回后依据controller里捕获的
+// KeyBody, KeyResp, KeyTrace参数输出访问日志，handler panic时按500记录后继续panic
+func AccessLog(conf *AccessLogConf, newCtrl func() IBase, h func(IBase, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bt := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		c := newCtrl()
+		defer func() {
+			if err := recover(); err != nil {
+				conf.Emit(c, r, http.StatusInternalServerError, bt)
+				panic(err)
+			}
+			conf.Emit(c, r, sw.status, bt)
+		}()
+		h(c, sw.wrap(), r)
+	}
+}
+
+// Emit 输出一条访问日志，可用于已有框架的后置filter里
+func (conf *AccessLogConf) Emit(c IBase, r *http.Request, status int, bt time.Time) {
+	if conf == nil {
+		conf = DefaultAccessLogConf
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	entry := &AccessLogEntry{
+		Time:    bt,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Remote:  r.RemoteAddr,
+		Status:  status,
+		Latency: time.Since(bt),
+	}
+
+	if trace := GetTrace(c); trace != nil {
+		entry.TraceID = trace.ID
+	}
+
+	if v, ok := c.GetParam(KeyBody); ok {
+		if body, ok := v.([]byte); ok {
+			entry.Req = conf.format(body, r.Header.Get("Content-Type"))
+		}
+	}
+
+	if ret, resp, ok := respRet(c); ok {
+		entry.Ret = ret
+		entry.Resp = conf.format(resp, "")
+	}
+
+	sink := conf.Sink
+	if sink == nil {
+		sink = loggerAccessLogSink{}
+	}
+	sink.WriteAccessLog(entry)
+}
+
+// respRet 返回Base捕获的返回内容及其中的ret，没有返回时ok为false
+func respRet(c IBase) (ret Code, resp []byte, ok bool) {
+	v, ok := c.GetParam(KeyResp)
+	if !ok {
+		return
+	}
+	if resp, ok = v.([]byte); !ok {
+		return
+	}
+
+	var r struct {
+		Ret Code `json:"ret"`
+	}
+	json.Unmarshal(resp, &r)
+	ret = r.Ret
+	return
+}
+
+func (conf *AccessLogConf) format(body []byte, contentType string) string {
+	if len(conf.MaskFields) > 0 {
+		body = conf.mask(body, contentType)
+	}
+
+	if n := conf.MaxBodyLen; n > 0 && len(body) > n {
+		return string(body[:n]) + "...(" + strconv.Itoa(len(body)) + " bytes)"
+	}
+	return string(body)
+}
+
+// mask json及表单格式的body脱敏，其它格式原样返回
+func (conf *AccessLogConf) mask(body []byte, contentType string) []byte {
+	fields := make(map[string]bool, len(conf.MaskFields))
+	for _, f := range conf.MaskFields {
+		fields[strings.ToLower(f)] = true
+	}
+
+	maskValue := conf.MaskValue
+	if maskValue == "" {
+		maskValue = "***"
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		return maskForm(body, fields, maskValue)
+	}
+
+	masked, err := maskJSON(body, fields, maskValue)
+	if err != nil {
+		return body
+	}
+	return masked
+}
+
+// maskJSON 逐个token重写json，保持key的顺序及数字的原始写法
+func maskJSON(body []byte, fields map[string]bool, maskValue string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	out := &bytes.Buffer{}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	write := func(v interface{}) {
+		enc.Encode(v)
+		out.Truncate(out.Len() - 1) // Encode会追加换行
+	}
+
+	type frame struct {
+		object   bool
+		afterKey bool
+		n        int
+	}
+	var stack []*frame
+	sep := func() {
+		if len(stack) == 0 {
+			return
+		}
+		f := stack[len(stack)-1]
+		if f.afterKey {
+			f.afterKey = false
+			return
+		}
+		if f.n > 0 {
+			out.WriteByte(',')
+		}
+		f.n++
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				sep()
+				stack = append(stack, &frame{object: delim == '{'})
+			default:
+				stack = stack[:len(stack)-1]
+			}
+			out.WriteByte(byte(delim))
+			continue
+		}
+
+		if len(stack) > 0 {
+			if f := stack[len(stack)-1]; f.object && !f.afterKey {
+				key, _ := tok.(string)
+				sep()
+				write(key)
+				out.WriteByte(':')
+				if fields[strings.ToLower(key)] {
+					var raw json.RawMessage
+					if err := dec.Decode(&raw); err != nil {
+						return nil, err
+					}
+					write(maskValue)
+					continue
+				}
+				f.afterKey = true
+				continue
+			}
+		}
+
+		sep()
+		if n, ok := tok.(json.Number); ok {
+			out.WriteString(string(n))
+			continue
+		}
+		write(tok)
+	}
+	return out.Bytes(), nil
+}
+
+// maskForm 保持参数顺序，只替换需要脱敏的值
+func maskForm(body []byte, fields map[string]bool, maskValue string) []byte {
+	pairs := strings.Split(string(body), "&")
+	for i, pair := range pairs {
+		pos := strings.Index(pair, "=")
+		if pos < 0 {
+			continue
+		}
+		key, err := url.QueryUnescape(pair[:pos])
+		if err != nil {
+			continue
+		}
+		if fields[strings.ToLower(key)] {
+			pairs[i] = pair[:pos+1] + url.QueryEscape(maskValue)
+		}
+	}
+	return []byte(strings.Join(pairs, "&"))
+}
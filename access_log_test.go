@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var entry *AccessLogEntry
+	conf := &AccessLogConf{
+		Sink:       AccessLogSinkFunc(func(e *AccessLogEntry) { entry = e }),
+		MaxBodyLen: 64,
+		MaskFields: []string{"password"},
+	}
+
+	h := AccessLog(conf, func() IBase { return &Base{} }, func(c IBase, w http.ResponseWriter, r *http.Request) {
+		c.ReadBody(r)
+		w.WriteHeader(http.StatusCreated)
+		c.ReplyFailWithMsg(w, CodeSrv, strings.Repeat("x", 100))
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"id":1234567890123456789,"Password":{"a":1},"b":[1,"<x>"]}`))
+	h(httptest.NewRecorder(), r)
+
+	if entry.Status != http.StatusCreated {
+		t.Errorf("status: %d", entry.Status)
+	}
+	if entry.Ret != CodeSrv {
+		t.Errorf("ret: %d", entry.Ret)
+	}
+	if want := `{"id":1234567890123456789,"Password":"***","b":[1,"<x>"]}`; entry.Req != want {
+		t.Errorf("req: %s, want: %s", entry.Req, want)
+	}
+	if !strings.HasSuffix(entry.Resp, " bytes)") || !strings.HasPrefix(entry.Resp, `{"ret":`) {
+		t.Errorf("resp not truncated: %s", entry.Resp)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("user=a&password=secret&x=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	h(httptest.NewRecorder(), r)
+	if want := "user=a&password=%2A%2A%2A&x=1"; entry.Req != want {
+		t.Errorf("form req: %s, want: %s", entry.Req, want)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("not json"))
+	h(httptest.NewRecorder(), r)
+	if entry.Req != "not json" {
+		t.Errorf("raw req: %s", entry.Req)
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestAccessLogWriter(t *testing.T) {
+	var entry *AccessLogEntry
+	conf := &AccessLogConf{
+		Sink: AccessLogSinkFunc(func(e *AccessLogEntry) { entry = e }),
+	}
+
+	h := AccessLog(conf, func() IBase { return &Base{} }, func(c IBase, w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("flusher hidden")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			t.Error("pusher not implemented by underlying writer")
+		}
+		if _, ok := w.(http.Hijacker); ok != (r.URL.Path == "/ws") {
+			t.Errorf("hijacker: %v, path: %s", ok, r.URL.Path)
+		}
+		if r.URL.Path == "/ws" {
+			w.(http.Hijacker).Hijack()
+		}
+	})
+
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if entry.Status != http.StatusOK {
+		t.Errorf("status: %d", entry.Status)
+	}
+
+	h(hijackRecorder{httptest.NewRecorder()}, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if entry.Status != http.StatusSwitchingProtocols {
+		t.Errorf("hijack status: %d", entry.Status)
+	}
+
+	h = AccessLog(conf, func() IBase { return &Base{} }, func(c IBase, w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})
+	func() {
+		defer func() {
+			if err := recover(); err != "oops" {
+				t.Errorf("panic not propagated: %v", err)
+			}
+		}()
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	if entry.Status != http.StatusInternalServerError {
+		t.Errorf("panic status: %d", entry.Status)
+	}
+}
@@ -0,0 +1,135 @@
+// 此文件定义内置的管理接口：存活、就绪、编译信息、文件句柄限制、异步任务、goroutine及pprof，
+// 只允许内网及本机访问
+
+package utils
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+)
+
+// AdminListenerName AddAdminListener添加的监听名
+const AdminListenerName = "admin"
+
+// NewAdminHandler 返回管理接口，提供以下路径：
+//
+//	/health       存活检查，总是返回ok
+//	/ready        就绪检查，srv退出排空时返回503，srv为nil时同/health
+//	/buildinfo    编译信息
+//	/rlimit       当前RlimitNofile
+//	/async_tasks  异步任务数及名字
+//	/goroutines   goroutine数
+//	/metrics      DefaultMetrics，Prometheus text格式
+//	/debug/pprof/ pprof
+//
+// 挂在主监听的子路径下时需配合http.StripPrefix使用
+func NewAdminHandler(srv *Server) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	if srv != nil {
+		mux.Handle("/ready", srv.ReadyHandler())
+	} else {
+		mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+	}
+
+	mux.HandleFunc("/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		info := map[string]interface{}{
+			"go_version": runtime.Version(),
+		}
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			info["path"] = bi.Path
+			info["main"] = bi.Main
+			settings := make(map[string]string)
+			for _, s := range bi.Settings {
+				settings[s.Key] = s.Value
+			}
+			info["settings"] = settings
+		}
+		writeAdminJSON(w, info)
+	})
+
+	mux.HandleFunc("/rlimit", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, map[string]interface{}{
+			"nofile": RlimitNofile(),
+		})
+	})
+
+	mux.HandleFunc("/async_tasks", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, map[string]interface{}{
+			"num":   AsyncTaskNum(),
+			"tasks": AsyncTaskRunning(),
+		})
+	})
+
+	mux.HandleFunc("/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, map[string]interface{}{
+			"num": runtime.NumGoroutine(),
+		})
+	})
+
+	mux.Handle("/metrics", DefaultMetrics)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return InnerOnly(mux)
+}
+
+// AddAdminListener 在addr上添加名为AdminListenerName的监听，提供NewAdminHandler的管理接口
+func (srv *Server) AddAdminListener(addr string) error {
+	return srv.AddListener(&ListenerConf{
+		Name:    AdminListenerName,
+		Addr:    addr,
+		Handler: NewAdminHandler(srv),
+	})
+}
+
+// InnerOnly 只允许本机(包括unix socket)及内网ipv4地址访问h，其它返回403
+func InnerOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isInnerRemote(r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isInnerRemote IsInnerIp只能处理ipv4，其它地址需先处理
+func isInnerRemote(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// unix socket的RemoteAddr为空或@
+		return remoteAddr == "" || remoteAddr == "@"
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return IsInnerIp(ip4.String())
+	}
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	h := NewAdminHandler(nil)
+
+	for _, c := range []struct {
+		remote string
+		path   string
+		code   int
+	}{
+		{"127.0.0.1:1234", "/health", http.StatusOK},
+		{"10.1.2.3:1234", "/ready", http.StatusOK},
+		{"[::1]:1234", "/goroutines", http.StatusOK},
+		{"@", "/rlimit", http.StatusOK},
+		{"192.168.1.1:1234", "/debug/pprof/", http.StatusOK},
+		{"8.8.8.8:1234", "/health", http.StatusForbidden},
+		{"[2001:db8::1]:1234", "/health", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.RemoteAddr = c.remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("remote: %s, path: %s, code: %d, want: %d", c.remote, c.path, w.Code, c.code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/async_tasks", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result["num"]; !ok {
+		t.Errorf("async tasks: %s", w.Body)
+	}
+}
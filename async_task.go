@@ -1,49 +1,188 @@
 package utils
 
 import (
-	"sync/atomic"
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
 	"time"
 )
 
 var (
 	AsyncTaskChan = make(chan struct{}, 0)
-	asyncTaskNum  = new(int32)
+
+	asyncTaskCtx, asyncTaskCancel = context.WithCancel(context.Background())
+	asyncTaskOnce                 sync.Once
+
+	asyncTaskMu   sync.Mutex
+	asyncTaskCond = sync.NewCond(&asyncTaskMu)
+	asyncTaskNum  int
+	asyncTaskLive = make(map[string]int)
 )
 
 func AsyncTaskEnter() {
-	atomic.AddInt32(asyncTaskNum, 1)
+	asyncTaskMu.Lock()
+	asyncTaskNum++
+	asyncTaskMu.Unlock()
 }
 
 func AsyncTaskExit() {
-	atomic.AddInt32(asyncTaskNum, -1)
+	asyncTaskMu.Lock()
+	asyncTaskExitLocked()
+	asyncTaskMu.Unlock()
 }
 
-func AsyncTaskShutdown(timeout time.Duration) {
-	if timeout == 0 {
-		return
+func asyncTaskExitLocked() {
+	if asyncTaskNum--; asyncTaskNum <= 0 {
+		asyncTaskCond.Broadcast()
 	}
+}
 
-	n := atomic.LoadInt32(asyncTaskNum)
-	if n == 0 {
-		return
-	}
+// AsyncTaskNum 返回当前未结束的异步任务数
+func AsyncTaskNum() int {
+	asyncTaskMu.Lock()
+	defer asyncTaskMu.Unlock()
+	return asyncTaskNum
+}
+
+// AsyncTask 一组具名异步任务，可单独等待此组任务结束并获取错误
+type AsyncTask struct {
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs MultiError
+}
+
+func NewAsyncTask() *AsyncTask {
+	return &AsyncTask{}
+}
+
+// Go 启动名为name的异步任务，AsyncTaskShutdown时ctx会被cancel，
+// 返回的error及panic会被收集，可通过Wait获取
+func (at *AsyncTask) Go(name string, f func(ctx context.Context) error) {
+	at.wg.Add(1)
+	goAsyncTask(name, f, func(err error) {
+		if err != nil {
+			at.mu.Lock()
+			at.errs = append(at.errs, err)
+			at.mu.Unlock()
+		}
+		at.wg.Done()
+	})
+}
+
+// Wait 等待此组内所有任务结束，返回此组收集到的全部错误
+func (at *AsyncTask) Wait() error {
+	at.wg.Wait()
+	return at.Err()
+}
+
+// Err 返回此组目前收集到的错误
+func (at *AsyncTask) Err() error {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return append(MultiError(nil), at.errs...).ErrorOrNil()
+}
+
+// AsyncTaskGo 启动名为name的异步任务，返回的error及panic只记录日志
+func AsyncTaskGo(name string, f func(ctx context.Context) error) {
+	goAsyncTask(name, f, nil)
+}
 
-	close(AsyncTaskChan)
+func goAsyncTask(name string, f func(ctx context.Context) error, done func(error)) {
+	asyncTaskEnterNamed(name)
 
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+	go func() {
+		var err error
+		bt := time.Now()
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("async task %s panic: %v", name, r)
+				GetLogger().Error("utils.AsyncTask recover", "name", name, "err", r, "stack", string(debug.Stack()))
+			} else if err != nil {
+				err = fmt.Errorf("async task %s: %v", name, err)
+				GetLogger().Warn("utils.AsyncTask error", "name", name, "err", err)
+			}
 
-	tick := time.NewTicker(time.Millisecond)
-	defer tick.Stop()
+			observeAsyncTask(name, err, bt)
+			asyncTaskExitNamed(name)
 
-	for {
-		select {
-		case <-timer.C:
-			return
-		case <-tick.C:
-			if atomic.LoadInt32(asyncTaskNum) == 0 {
-				return
+			if done != nil {
+				done(err)
 			}
+		}()
+
+		err = f(asyncTaskCtx)
+	}()
+}
+
+func asyncTaskEnterNamed(name string) {
+	asyncTaskMu.Lock()
+	asyncTaskNum++
+	asyncTaskLive[name]++
+	asyncTaskMu.Unlock()
+}
+
+func asyncTaskExitNamed(name string) {
+	asyncTaskMu.Lock()
+	if asyncTaskLive[name]--; asyncTaskLive[name] <= 0 {
+		delete(asyncTaskLive, name)
+	}
+	asyncTaskExitLocked()
+	asyncTaskMu.Unlock()
+}
+
+// AsyncTaskRunning 返回仍在运行的具名任务，相同名字的任务会重复出现
+func AsyncTaskRunning() (names []string) {
+	asyncTaskMu.Lock()
+	defer asyncTaskMu.Unlock()
+
+	for name, n := range asyncTaskLive {
+		for i := 0; i < n; i++ {
+			names = append(names, name)
 		}
 	}
+	sort.Strings(names)
+	return
+}
+
+// AsyncTaskShutdown 通知异步任务退出(关闭AsyncTaskChan并cancel任务ctx)，最多等待timeout，
+// 最后一个任务结束时立即返回，可重复调用，返回任务是否全部结束、剩余任务数
+// 以及超时时仍在运行的具名任务
+func AsyncTaskShutdown(timeout time.Duration) (done bool, remain int, abandoned []string) {
+	if timeout == 0 {
+		remain = AsyncTaskNum()
+		done = remain == 0
+		if !done {
+			abandoned = AsyncTaskRunning()
+		}
+		return
+	}
+
+	asyncTaskOnce.Do(func() {
+		close(AsyncTaskChan)
+		asyncTaskCancel()
+	})
+
+	asyncTaskMu.Lock()
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		asyncTaskMu.Lock()
+		timedOut = true
+		asyncTaskCond.Broadcast()
+		asyncTaskMu.Unlock()
+	})
+	for asyncTaskNum > 0 && !timedOut {
+		asyncTaskCond.Wait()
+	}
+	remain = asyncTaskNum
+	asyncTaskMu.Unlock()
+	timer.Stop()
+
+	done = remain == 0
+	if !done {
+		abandoned = AsyncTaskRunning()
+		GetLogger().Warn("utils.AsyncTaskShutdown timeout", "remain", remain, "tasks", abandoned)
+	}
+	return
 }
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncTaskGo(t *testing.T) {
+	at := NewAsyncTask()
+	at.Go("ok", func(ctx context.Context) error { return nil })
+	at.Go("fail", func(ctx context.Context) error { return errors.New("boom") })
+	at.Go("panic", func(ctx context.Context) error { panic("oops") })
+
+	err := at.Wait()
+	me, ok := err.(MultiError)
+	if !ok || len(me) != 2 {
+		t.Fatalf("err: %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "async task fail: boom") || !strings.Contains(msg, "async task panic panic: oops") {
+		t.Errorf("err: %s", msg)
+	}
+	if n := AsyncTaskNum(); n != 0 {
+		t.Errorf("async task num: %d", n)
+	}
+}
+
+// AsyncTaskShutdown只能执行一次，在子进程里测试以免影响其它用例
+func TestAsyncTaskShutdown(t *testing.T) {
+	if os.Getenv("UTILS_TEST_ASYNC_SHUTDOWN") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAsyncTaskShutdown$", "-test.v")
+		cmd.Env = append(os.Environ(), "UTILS_TEST_ASYNC_SHUTDOWN=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "--- PASS") {
+			t.Fatalf("err: %v, output:\n%s", err, out)
+		}
+		return
+	}
+
+	cancelled := make(chan bool, 1)
+	AsyncTaskGo("ctx", func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- true
+		return ctx.Err()
+	})
+
+	release := make(chan bool)
+	AsyncTaskGo("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	done, remain, abandoned := AsyncTaskShutdown(time.Millisecond * 100)
+	if done || remain != 1 || len(abandoned) != 1 || abandoned[0] != "stuck" {
+		t.Fatalf("done: %v, remain: %d, abandoned: %v", done, remain, abandoned)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Error("task ctx not cancelled")
+	}
+	select {
+	case <-AsyncTaskChan:
+	default:
+		t.Error("AsyncTaskChan not closed")
+	}
+
+	// 再次调用不会panic，最后一个任务结束时立即返回
+	time.AfterFunc(time.Millisecond*50, func() { close(release) })
+	bt := time.Now()
+	done, remain, abandoned = AsyncTaskShutdown(time.Second * 10)
+	if !done || remain != 0 || abandoned != nil {
+		t.Fatalf("done: %v, remain: %d, abandoned: %v", done, remain, abandoned)
+	}
+	if d := time.Since(bt); d > time.Second {
+		t.Errorf("shutdown not woken up immediately: %s", d)
+	}
+}
@@ -1,10 +1,20 @@
 package utils
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
 )
 
 const (
@@ -26,8 +36,43 @@ const (
 	KeyTimeoutOccur = "_timeout_occur_"
 	// KeyCtxDone request context done value会存在此key对应params参数里
 	KeyCtxDone = "_ctx_done_"
+	// KeyBodyErr 读取request body时的错误会存在此key对应params参数里
+	KeyBodyErr = "_body_err_"
+	// KeyBodyMaxSize 设置此key(int64)可以覆盖BodyMaxSize
+	KeyBodyMaxSize = "_body_max_size_"
+)
+
+var (
+	// BodyMaxSize request body(解压后)最大长度，<=0表示不限制
+	BodyMaxSize int64 = 0
+	// DecodedBodyMaxSize BodyMaxSize不限制时，压缩过的request body解压后的最大长度，
+	// 防止很小的压缩数据解压出超大的body
+	DecodedBodyMaxSize int64 = 32 << 20
+
+	// ErrBodyTooLarge request body超过最大长度，此时返回的body是截断后的内容
+	ErrBodyTooLarge = errors.New("request body too large")
+	// ErrBodyEncoding 不支持的Content-Encoding
+	ErrBodyEncoding = errors.New("request body encoding not supported")
 )
 
+// BodyDecoders 定义Content-Encoding对应的解压方法
+var BodyDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		// 标准为zlib格式，兼容部分客户端直接发送的raw deflate
+		br := bufio.NewReader(r)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+	"br": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+}
+
 // IBase 所有Controller必须实现此接口
 type IBase interface {
 	SetParam(string, interface{})
@@ -58,15 +103,33 @@ func (base *Base) GetParam(key string) (value interface{}, ok bool) {
 }
 
 func (base *Base) ReadBody(r *http.Request) (body []byte) {
+	body, _ = base.ReadBodyE(r)
+	return
+}
+
+// ReadBodyE 读取request body，按Content-Encoding解压，并限制最大长度，
+// 出错时返回已读取的内容以及对应错误，用于区分截断或格式错误的body和空body
+func (base *Base) ReadBodyE(r *http.Request) (body []byte, err error) {
 	value, ok := base.GetParam(KeyBody)
 	if ok {
 		body = value.([]byte)
+		if value, ok := base.GetParam(KeyBodyErr); ok {
+			err = value.(error)
+		}
 		return
 	}
 
-	body, _ = ioutil.ReadAll(r.Body)
+	maxSize := BodyMaxSize
+	if value, ok := base.GetParam(KeyBodyMaxSize); ok {
+		maxSize = value.(int64)
+	}
+
+	body, err = readBody(r, maxSize)
 
 	base.SetParam(KeyBody, body)
+	if err != nil {
+		base.SetParam(KeyBodyErr, err)
+	}
 
 	if ctxDone, ok := r.Context().Value(CtxDone).(chan struct{}); ok {
 		base.SetParam(KeyCtxDone, ctxDone)
@@ -74,6 +137,69 @@ func (base *Base) ReadBody(r *http.Request) (body []byte) {
 	return
 }
 
+// ReadBodyOrFail 读取request body，出错时直接返回CodePara错误
+func (base *Base) ReadBodyOrFail(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := base.ReadBodyE(r)
+	if err != nil {
+		base.ReplyFailWithMsg(w, CodePara, fmt.Sprintf("%s: %v", CodeMap[CodePara], err))
+		return
+	}
+
+	ok = true
+	return
+}
+
+func readBody(r *http.Request, maxSize int64) (body []byte, err error) {
+	if r.Body == nil {
+		return
+	}
+
+	// Content-Encoding按编码的先后顺序列出，需倒序解压
+	var reader io.Reader = r.Body
+	encodings := strings.Split(r.Header.Get("Content-Encoding"), ",")
+	decoded := false
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+
+		decoder, ok := BodyDecoders[encoding]
+		if !ok {
+			err = ErrBodyEncoding
+			return
+		}
+
+		reader, err = decoder(reader)
+		if err != nil {
+			err = fmt.Errorf("request body malformed: %v", err)
+			return
+		}
+		decoded = true
+	}
+
+	if decoded && maxSize <= 0 {
+		maxSize = DecodedBodyMaxSize
+	}
+
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	body, err = ioutil.ReadAll(reader)
+	if err != nil {
+		err = fmt.Errorf("request body malformed: %v", err)
+		return
+	}
+
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		body = body[:maxSize]
+		err = ErrBodyTooLarge
+		return
+	}
+	return
+}
+
 func (base *Base) ReplyRaw(w http.ResponseWriter, data []byte) {
 	base.SetParam(KeyResp, data)
 
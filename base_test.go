@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBodyE(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte(`{"a":1}`))
+	zw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/", buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	base := &Base{}
+	body, err := base.ReadBodyE(r)
+	if err != nil || string(body) != `{"a":1}` {
+		t.Fatalf("gzip body: %s, err: %v", body, err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	base = &Base{}
+	base.SetParam(KeyBodyMaxSize, int64(4))
+	body, err = base.ReadBodyE(r)
+	if err != ErrBodyTooLarge || string(body) != "0123" {
+		t.Fatalf("limit body: %s, err: %v", body, err)
+	}
+	if _, err := base.ReadBodyE(r); err != ErrBodyTooLarge {
+		t.Fatalf("cached err: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	base = &Base{}
+	if _, err := base.ReadBodyE(r); err == nil {
+		t.Fatal("malformed body should return err")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	w := httptest.NewRecorder()
+	base = &Base{}
+	base.SetParam(KeyBodyMaxSize, int64(4))
+	if _, ok := base.ReadBodyOrFail(w, r); ok || !strings.Contains(w.Body.String(), `"ret":3`) {
+		t.Fatalf("ReadBodyOrFail resp: %s", w.Body.String())
+	}
+
+	// 先deflate再gzip
+	buf = new(bytes.Buffer)
+	zw = gzip.NewWriter(buf)
+	fw := zlib.NewWriter(zw)
+	fw.Write([]byte(`{"b":2}`))
+	fw.Close()
+	zw.Close()
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf.Bytes()))
+	r.Header.Set("Content-Encoding", "deflate, gzip")
+	base = &Base{}
+	if body, err := base.ReadBodyE(r); err != nil || string(body) != `{"b":2}` {
+		t.Fatalf("stacked body: %s, err: %v", body, err)
+	}
+
+	// 解压后的body默认也有长度限制
+	old := DecodedBodyMaxSize
+	DecodedBodyMaxSize = 4
+	defer func() { DecodedBodyMaxSize = old }()
+	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf.Bytes()))
+	r.Header.Set("Content-Encoding", "deflate, gzip")
+	base = &Base{}
+	if _, err := base.ReadBodyE(r); err != ErrBodyTooLarge {
+		t.Fatalf("decoded limit err: %v", err)
+	}
+}
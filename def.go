@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"strings"
 	"sync"
 )
 
@@ -96,3 +97,22 @@ func (trace *Trace) Decode(s string) {
 
 	json.Unmarshal([]byte(s), trace)
 }
+
+// MultiError 用于聚合多个错误
+type MultiError []error
+
+func (me MultiError) Error() string {
+	s := make([]string, 0, len(me))
+	for _, err := range me {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+// ErrorOrNil 没有错误时返回nil
+func (me MultiError) ErrorOrNil() error {
+	if len(me) == 0 {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,13 @@
+package utils
+
+import "os"
+
+// windows下不支持flock，加锁总是成功
+
+func flock(f *os.File, exclusive, nonblock bool) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
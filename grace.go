@@ -1,34 +1,98 @@
 package utils
 
 import (
-	"context"
-	"log"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var GRACEFUL_ENV = "GRACEFUL=true"
 
+var gracefulEnvOnce sync.Once
+
+// ListenerConf 定义一个具名监听
+type ListenerConf struct {
+	Name      string       // 唯一名字，graceful restart时子进程据此找到继承的fd
+	Network   string       // tcp, tcp4, tcp6或unix，为空时为tcp
+	Addr      string       // 监听地址，unix时为socket文件路径
+	Handler   http.Handler // 为空时使用NewServer传入的handler
+	TLSConfig *tls.Config  // 不为空时为TLS监听，未设置NextProtos时启用http/2
+	CertFile  string       // 不为空时为TLS监听，证书可通过ReloadCertificates热加载
+	KeyFile   string
+}
+
+type serverListener struct {
+	conf         ListenerConf
+	listener     net.Listener
+	server       *http.Server
+	certReloader *certReloader
+	conns        *connTracker
+}
+
+// DefaultListenerName NewServer时addr对应的监听名
+const DefaultListenerName = "default"
+
+// DefaultReadyTimeout graceful restart时等待子进程就绪的默认时长
+const DefaultReadyTimeout = time.Second * 30
+
 type Server struct {
-	server   *http.Server
-	listener net.Listener
+	server      *http.Server
+	listeners   []*serverListener
+	defaultConf ListenerConf // 默认监听的配置，可通过WithTLSFiles等选项修改
+	initErr     error        // 创建默认监听失败时ListenAndServe返回此错误
+
+	isGraceful          bool
+	shutdownTime        time.Duration
+	startTime           time.Duration
+	readyTimeout        time.Duration
+	drainTime           time.Duration
+	signalChan          chan os.Signal
+	noSignal            bool
+	noKeepAlives        bool
+	maxConns            int
+	maxConnsPerIP       int
+	pidFile             string
+	pidLock             bool
+	lockFile            *os.File
+	noAsyncTaskShutdown bool
+	cmdChan             chan *serverCmd
+	done                chan struct{}
 
-	isGraceful   bool
-	shutdownTime time.Duration
-	startTime    time.Duration
-	signalChan   chan os.Signal
+	mu           sync.Mutex
+	hooks        serverHooks
+	started      int32
+	ready        int32
+	forcedClosed int64
 }
 
+// NewServer startTime为子进程就绪后老进程停止前的等待时长，
+// 子进程是否就绪通过继承的管道通知，见SetReadyTimeout
 func NewServer(addr string, handler http.Handler, shutdownTime, startTime, timeout time.Duration) *Server {
+	return NewServerWithOptions(addr, handler,
+		WithShutdownTime(shutdownTime),
+		WithStartTime(startTime),
+		WithTimeout(timeout),
+	)
+}
+
+// NewServerWithOptions 通过ServerOption配置Server，未设置的选项同ListenAndServe的默认值
+func NewServerWithOptions(addr string, handler http.Handler, opts ...ServerOption) *Server {
 	isGraceful := false
 
-	GRACEFUL_ENV = filepath.Base(os.Args[0]) + "_" + GRACEFUL_ENV
+	gracefulEnvOnce.Do(func() {
+		GRACEFUL_ENV = filepath.Base(os.Args[0]) + "_" + GRACEFUL_ENV
+	})
 
 	for _, v := range os.Environ() {
 		if v == GRACEFUL_ENV {
@@ -37,106 +101,474 @@ func NewServer(addr string, handler http.Handler, shutdownTime, startTime, timeo
 		}
 	}
 
-	return &Server{
+	srv := &Server{
 		server: &http.Server{
 			Addr:         addr,
 			Handler:      handler,
-			ReadTimeout:  timeout,
-			WriteTimeout: timeout,
+			ReadTimeout:  defaultServerTimeout,
+			WriteTimeout: defaultServerTimeout,
 		},
 
 		isGraceful:   isGraceful,
-		signalChan:   make(chan os.Signal),
-		shutdownTime: shutdownTime,
-		startTime:    startTime,
+		signalChan:   make(chan os.Signal, 1),
+		cmdChan:      make(chan *serverCmd),
+		done:         make(chan struct{}),
+		shutdownTime: defaultShutdownTime,
+		startTime:    defaultStartTime,
+		readyTimeout: DefaultReadyTimeout,
+		defaultConf: ListenerConf{
+			Name: DefaultListenerName,
+			Addr: addr,
+		},
+	}
+	for _, opt := range opts {
+		opt(srv)
 	}
+
+	srv.initErr = srv.AddListener(&srv.defaultConf)
+	return srv
 }
 
-func (srv *Server) ListenAndServe() (err error) {
-	var ln net.Listener
+// AddListener 添加具名监听，需在ListenAndServe前调用，
+// graceful restart时所有监听都会传给子进程
+func (srv *Server) AddListener(conf *ListenerConf) error {
+	// 名字会写入形如name:fd,name:fd的环境变量传给子进程
+	if conf.Name == "" || strings.ContainsAny(conf.Name, ",:") {
+		return fmt.Errorf("listener name %q invalid: must be non-empty and not contain ',' or ':'", conf.Name)
+	}
+
+	c := *conf
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+	if c.Handler == nil {
+		c.Handler = srv.server.Handler
+	}
+
+	for _, sl := range srv.listeners {
+		if sl.conf.Name == c.Name {
+			return fmt.Errorf("listener %s already exists", c.Name)
+		}
+	}
+
+	config, cr, err := tlsConfig(&c)
+	if err != nil {
+		return fmt.Errorf("listener %s: %v", c.Name, err)
+	}
+	c.TLSConfig = config
+
+	conns := newConnTracker()
+	connState := conns.track
+	if userConnState := srv.server.ConnState; userConnState != nil {
+		connState = func(conn net.Conn, state http.ConnState) {
+			conns.track(conn, state)
+			userConnState(conn, state)
+		}
+	}
+
+	server := &http.Server{
+		Addr:              c.Addr,
+		Handler:           c.Handler,
+		TLSConfig:         c.TLSConfig,
+		ReadTimeout:       srv.server.ReadTimeout,
+		ReadHeaderTimeout: srv.server.ReadHeaderTimeout,
+		WriteTimeout:      srv.server.WriteTimeout,
+		IdleTimeout:       srv.server.IdleTimeout,
+		MaxHeaderBytes:    srv.server.MaxHeaderBytes,
+		ErrorLog:          srv.server.ErrorLog,
+		ConnState:         connState,
+	}
+	server.SetKeepAlivesEnabled(!srv.noKeepAlives)
+
+	srv.listeners = append(srv.listeners, &serverListener{
+		conf:         c,
+		server:       server,
+		certReloader: cr,
+		conns:        conns,
+	})
+	return nil
+}
+
+// SetReadyTimeout 设置graceful restart时等待子进程就绪的时长，
+// 超时或子进程提前退出时老进程继续服务
+func (srv *Server) SetReadyTimeout(d time.Duration) {
+	srv.readyTimeout = d
+}
+
+// gracefulListenersEnv 用于告诉子进程每个监听对应的fd，格式为name:fd,name:fd
+func gracefulListenersEnv() string {
+	return filepath.Base(os.Args[0]) + "_GRACEFUL_LISTENERS"
+}
+
+// inheritedListeners 返回从父进程继承的监听，name -> fd
+func (srv *Server) inheritedListeners() map[string]uintptr {
+	fds := make(map[string]uintptr)
+	if !srv.isGraceful {
+		// 由systemd socket activation启动
+		if sd := srv.sdListeners(); sd != nil {
+			return sd
+		}
+		return fds
+	}
+
+	manifest, ok := os.LookupEnv(gracefulListenersEnv())
+	if !ok {
+		// 老版本父进程只会传递一个监听
+		fds[DefaultListenerName] = 3
+		return fds
+	}
 
-	if srv.isGraceful {
-		file := os.NewFile(3, "")
-		ln, err = net.FileListener(file)
+	for _, item := range strings.Split(manifest, ",") {
+		pos := strings.LastIndex(item, ":")
+		if pos <= 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(item[pos+1:])
 		if err != nil {
-			return
+			continue
+		}
+		fds[item[:pos]] = uintptr(fd)
+	}
+	return fds
+}
+
+func (srv *Server) listen() (err error) {
+	fds := srv.inheritedListeners()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, sl := range srv.listeners {
+		if fd, ok := fds[sl.conf.Name]; ok {
+			file := os.NewFile(fd, sl.conf.Name)
+			sl.listener, err = net.FileListener(file)
+			file.Close()
+		} else {
+			if sl.conf.Network == "unix" {
+				err = removeStaleSocket(sl.conf.Addr)
+			}
+			if err == nil {
+				sl.listener, err = net.Listen(sl.conf.Network, sl.conf.Addr)
+			}
 		}
-	} else {
-		ln, err = net.Listen("tcp", srv.server.Addr)
 		if err != nil {
+			err = fmt.Errorf("listener %s: %v", sl.conf.Name, err)
+			srv.closeListeners()
 			return
 		}
 	}
+	return
+}
 
-	srv.listener = ln
+// removeStaleSocket 删除之前进程遗留的unix socket文件，仍有进程在监听时返回错误
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
 
-	go func() {
-		if err := srv.server.Serve(srv.listener); err != http.ErrServerClosed {
-			log.Printf("http Serve error: %v\n", err)
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func (srv *Server) closeListeners() {
+	for _, sl := range srv.listeners {
+		if sl.listener != nil {
+			sl.listener.Close()
 		}
-	}()
+	}
+}
 
-	srv.handleSignal()
+// ListenAndServe 开始服务，直到收到退出信号或调用Shutdown、Restart成功后返回
+func (srv *Server) ListenAndServe() (err error) {
+	atomic.StoreInt32(&srv.started, 1)
+	defer close(srv.done)
 
-	return
-}
+	if err = srv.initErr; err != nil {
+		return
+	}
 
-func (srv *Server) handleSignal() {
-	signal.Notify(srv.signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	for s := range srv.signalChan {
-		switch s {
-		case syscall.SIGINT, syscall.SIGTERM:
-			ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTime)
-			srv.server.Shutdown(ctx)
-			cancel()
-		case syscall.SIGHUP:
-			err := srv.fork()
-			if err != nil {
-				log.Printf("start new process failed, please retry: %v\n", err)
-				continue
+	if err = srv.lockPidFile(); err != nil {
+		return
+	}
+
+	if err = srv.listen(); err != nil {
+		srv.removePidFile()
+		return
+	}
+
+	srv.hooks.run(&srv.hooks.onStart)
+
+	for _, sl := range srv.listeners {
+		go func(sl *serverListener) {
+			var err error
+			l := srv.limitListener(sl.listener)
+			if sl.server.TLSConfig != nil {
+				err = sl.server.ServeTLS(l, "", "")
+			} else {
+				err = sl.server.Serve(l)
 			}
+			if err != http.ErrServerClosed {
+				GetLogger().Error("utils.Server serve error", "listener", sl.conf.Name, "err", err)
+			}
+		}(sl)
+	}
 
-			time.Sleep(srv.startTime)
+	atomic.StoreInt32(&srv.ready, 1)
+	srv.writePidFile()
+	srv.notifyReady()
+	srv.hooks.run(&srv.hooks.onReady)
 
-			ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTime)
-			srv.server.Shutdown(ctx)
-			cancel()
+	sdStop := make(chan struct{})
+	sdWatchdog(sdStop)
+	defer close(sdStop)
+
+	srv.run()
+
+	return
+}
+
+// run 处理信号及Shutdown、Restart调用，直到退出
+func (srv *Server) run() {
+	if !srv.noSignal {
+		signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+		if certReloadSignal != nil {
+			signals = append(signals, certReloadSignal)
+		}
+		signal.Notify(srv.signalChan, signals...)
+		defer signal.Stop(srv.signalChan)
+	}
+
+	for {
+		select {
+		case s := <-srv.signalChan:
+			switch s {
+			case syscall.SIGINT, syscall.SIGTERM:
+				sdNotify(SdStopping)
+				srv.shutdown(nil)
+				return
+			case syscall.SIGHUP:
+				if srv.restart() == nil {
+					return
+				}
+			default:
+				if s == certReloadSignal {
+					srv.ReloadCertificates()
+				}
+			}
+		case cmd := <-srv.cmdChan:
+			switch cmd.op {
+			case serverCmdShutdown:
+				sdNotify(SdStopping)
+				cmd.errC <- srv.shutdown(cmd.ctx)
+				return
+			case serverCmdRestart:
+				err := srv.restart()
+				cmd.errC <- err
+				if err == nil {
+					return
+				}
+			}
 		}
-		break
 	}
 }
 
+// restart 启动子进程，子进程就绪后老进程退出，失败时老进程继续服务
+func (srv *Server) restart() (err error) {
+	sdNotify(SdReloading)
+	if err = srv.fork(); err != nil {
+		GetLogger().Error("utils.Server start new process failed, keep serving, please retry", "err", err)
+		sdNotify(SdReady)
+		return
+	}
+
+	time.Sleep(srv.startTime)
+
+	srv.shutdown(nil)
+	return
+}
+
 func (srv *Server) fork() (err error) {
-	log.Println("grace restart...")
+	GetLogger().Info("utils.Server grace restart...")
+
+	listenersEnv, readyEnv, lockEnv := gracefulListenersEnv(), gracefulReadyEnv(), gracefulLockEnv()
 
 	var env []string
 	for _, v := range os.Environ() {
-		if v != GRACEFUL_ENV {
-			env = append(env, v)
+		if v == GRACEFUL_ENV || strings.HasPrefix(v, listenersEnv+"=") ||
+			strings.HasPrefix(v, readyEnv+"=") || strings.HasPrefix(v, lockEnv+"=") {
+			continue
+		}
+		// systemd相关的变量只对当前进程有效
+		if strings.HasPrefix(v, "LISTEN_PID=") || strings.HasPrefix(v, "LISTEN_FDS=") ||
+			strings.HasPrefix(v, "LISTEN_FDNAMES=") || strings.HasPrefix(v, "WATCHDOG_PID=") {
+			continue
 		}
+		env = append(env, v)
+	}
+
+	var files []*os.File
+	var manifest []string
+	for _, sl := range srv.listeners {
+		filer, ok := sl.listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			err = fmt.Errorf("listener %s: unsupported type %T", sl.conf.Name, sl.listener)
+			return
+		}
+		file, e := filer.File()
+		if e != nil {
+			err = fmt.Errorf("listener %s: %v", sl.conf.Name, e)
+			return
+		}
+		defer file.Close()
+
+		// 子进程继承后socket文件还要继续使用，父进程关闭监听时不能删除
+		if ul, ok := sl.listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		manifest = append(manifest, fmt.Sprintf("%s:%d", sl.conf.Name, 3+len(files)))
+		files = append(files, file)
+	}
+
+	// 子进程开始服务后通过此管道通知父进程
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	env = append(env,
+		GRACEFUL_ENV,
+		listenersEnv+"="+strings.Join(manifest, ","),
+		readyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	files = append(files, readyW)
+
+	// pid锁传给子进程，老进程退出后锁仍由子进程持有
+	if srv.lockFile != nil {
+		env = append(env, lockEnv+"="+strconv.Itoa(3+len(files)))
+		files = append(files, srv.lockFile)
 	}
-	env = append(env, GRACEFUL_ENV)
 
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = env
-	file, _ := srv.listener.(*net.TCPListener).File()
-	cmd.ExtraFiles = []*os.File{file}
+	cmd.ExtraFiles = files
 
 	err = cmd.Start()
+	for _, sl := range srv.listeners {
+		if e := setNonblock(sl.listener); e != nil {
+			GetLogger().Warn("utils.Server set listener nonblock failed", "listener", sl.conf.Name, "err", e)
+		}
+	}
 	if err != nil {
+		srv.rollback()
 		return
 	}
+	readyW.Close()
 
+	if err = srv.waitReady(cmd, readyR); err != nil {
+		srv.rollback()
+		return
+	}
+
+	GetLogger().Info("utils.Server new process ready", "pid", cmd.Process.Pid)
+	// systemd下由子进程接替主进程
+	sdNotify(fmt.Sprintf("MAINPID=%d\n%s", cmd.Process.Pid, SdReady))
+	return
+}
+
+// gracefulReadyEnv 用于告诉子进程就绪管道的fd
+func gracefulReadyEnv() string {
+	return filepath.Base(os.Args[0]) + "_GRACEFUL_READY"
+}
+
+// waitReady 等待子进程通过管道通知就绪，子进程退出或超时都视为失败，超时时杀掉子进程
+func (srv *Server) waitReady(cmd *exec.Cmd, readyR *os.File) (err error) {
+	readyC := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := readyR.Read(buf)
+		readyC <- n == 1
+	}()
+
+	exitC := make(chan error, 1)
+	go func() {
+		exitC <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(srv.readyTimeout)
+	defer timer.Stop()
+
+	select {
+	case ok := <-readyC:
+		if ok {
+			return
+		}
+		// 子进程没有通知就关闭了管道，一般是已经退出
+		select {
+		case <-exitC:
+			err = fmt.Errorf("new process %d exited before ready: %s", cmd.Process.Pid, cmd.ProcessState)
+		case <-timer.C:
+			cmd.Process.Kill()
+			<-exitC
+			err = fmt.Errorf("new process %d closed ready pipe without notify, killed: %s", cmd.Process.Pid, cmd.ProcessState)
+		}
+	case <-exitC:
+		err = fmt.Errorf("new process %d exited before ready: %s", cmd.Process.Pid, cmd.ProcessState)
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-exitC
+		err = fmt.Errorf("new process %d not ready in %s, killed: %s", cmd.Process.Pid, srv.readyTimeout, cmd.ProcessState)
+	}
 	return
 }
 
+// rollback 子进程启动失败时恢复老进程监听的设置
+func (srv *Server) rollback() {
+	for _, sl := range srv.listeners {
+		if ul, ok := sl.listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+	}
+}
+
+// notifyReady 通知systemd或graceful restart的父进程已开始服务
+func (srv *Server) notifyReady() {
+	// 子进程就绪由父进程通知systemd
+	if !srv.isGraceful {
+		sdNotify(fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), SdReady))
+		return
+	}
+
+	v, ok := os.LookupEnv(gracefulReadyEnv())
+	if !ok {
+		return
+	}
+	os.Unsetenv(gracefulReadyEnv())
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		GetLogger().Error("utils.Server notify ready failed", "err", err)
+	}
+}
+
 func ListenAndServe(addr string, handler http.Handler) error {
-	shutdownTime := time.Millisecond * 800
-	startTime := time.Millisecond * 200
-	timeout := time.Minute * 10
-	return NewServer(addr, handler, shutdownTime, startTime, timeout).ListenAndServe()
+	return NewServerWithOptions(addr, handler).ListenAndServe()
 }
 
 func ListenAndServeWithTimeout(addr string, handler http.Handler, shutdownTime, startTime, timeout time.Duration) error {
@@ -0,0 +1,82 @@
+// 此文件定义grace Server的编程控制接口，便于测试及嵌入其它程序
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+var ErrServerClosed = errors.New("utils: Server closed")
+
+const (
+	serverCmdShutdown = iota
+	serverCmdRestart
+)
+
+type serverCmd struct {
+	op   int
+	ctx  context.Context
+	errC chan error
+}
+
+// DisableSignals 不再处理SIGINT、SIGTERM、SIGHUP等信号，只能通过Shutdown、Restart控制，
+// 需在ListenAndServe前调用
+func (srv *Server) DisableSignals() {
+	srv.noSignal = true
+}
+
+// Shutdown 同收到SIGTERM，ctx结束后强制关闭剩余连接，
+// 有连接被强制关闭或异步任务未结束时返回error，
+// 还未调用ListenAndServe或Server已退出时返回ErrServerClosed
+func (srv *Server) Shutdown(ctx context.Context) error {
+	return srv.send(ctx, &serverCmd{op: serverCmdShutdown, ctx: ctx})
+}
+
+// Restart 同收到SIGHUP，子进程就绪且老进程退出后返回，失败时老进程继续服务，
+// 还未调用ListenAndServe或Server已退出时返回ErrServerClosed
+func (srv *Server) Restart() error {
+	return srv.send(context.Background(), &serverCmd{op: serverCmdRestart})
+}
+
+func (srv *Server) send(ctx context.Context, cmd *serverCmd) error {
+	if atomic.LoadInt32(&srv.started) == 0 {
+		return ErrServerClosed
+	}
+
+	cmd.errC = make(chan error, 1)
+
+	select {
+	case srv.cmdChan <- cmd:
+	case <-srv.done:
+		return ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-cmd.errC
+}
+
+// Addr 返回默认监听的实际地址，比如addr为:0时可据此得到端口，开始监听前返回nil
+func (srv *Server) Addr() net.Addr {
+	return srv.ListenerAddr(DefaultListenerName)
+}
+
+// ListenerAddr 返回名为name的监听的实际地址
+func (srv *Server) ListenerAddr(name string) net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, sl := range srv.listeners {
+		if sl.conf.Name == name && sl.listener != nil {
+			return sl.listener.Addr()
+		}
+	}
+	return nil
+}
+
+// Done ListenAndServe返回时关闭
+func (srv *Server) Done() <-chan struct{} {
+	return srv.done
+}
@@ -0,0 +1,186 @@
+// 此文件定义grace Server的生命周期钩子及退出时的连接排空
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type serverHooks struct {
+	mu             sync.Mutex
+	onStart        []func()
+	onReady        []func()
+	beforeShutdown []func()
+	afterShutdown  []func()
+}
+
+func (h *serverHooks) add(hooks *[]func(), f func()) {
+	h.mu.Lock()
+	*hooks = append(*hooks, f)
+	h.mu.Unlock()
+}
+
+func (h *serverHooks) run(hooks *[]func()) {
+	h.mu.Lock()
+	fs := *hooks
+	h.mu.Unlock()
+
+	for _, f := range fs {
+		f()
+	}
+}
+
+// OnStart 注册监听建立后、开始服务前执行的方法
+func (srv *Server) OnStart(f func()) {
+	srv.hooks.add(&srv.hooks.onStart, f)
+}
+
+// OnReady 注册开始服务后执行的方法，graceful restart时在通知父进程之后执行
+func (srv *Server) OnReady(f func()) {
+	srv.hooks.add(&srv.hooks.onReady, f)
+}
+
+// BeforeShutdown 注册退出前执行的方法，此时还在正常服务
+func (srv *Server) BeforeShutdown(f func()) {
+	srv.hooks.add(&srv.hooks.beforeShutdown, f)
+}
+
+// AfterShutdown 注册所有连接及异步任务结束(或超时)后执行的方法
+func (srv *Server) AfterShutdown(f func()) {
+	srv.hooks.add(&srv.hooks.afterShutdown, f)
+}
+
+// SetDrainTime 设置退出时ready状态置为false后、停止接收新请求前的等待时长，
+// 给负载均衡摘除本实例留出时间，默认为0
+func (srv *Server) SetDrainTime(d time.Duration) {
+	srv.drainTime = d
+}
+
+// SkipAsyncTaskShutdown 退出时不调用AsyncTaskShutdown，用于同一进程内有多个Server
+// 或嵌入其它程序时，异步任务由调用方自行结束
+func (srv *Server) SkipAsyncTaskShutdown() {
+	srv.noAsyncTaskShutdown = true
+}
+
+// Ready 返回是否可以接收流量，开始服务后为true，退出排空时为false
+func (srv *Server) Ready() bool {
+	return atomic.LoadInt32(&srv.ready) == 1
+}
+
+// ReadyHandler 返回readiness检查接口，ready时返回200，否则返回503
+func (srv *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !srv.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// ForcedClosed 返回最近一次退出时因超时被强制关闭的连接数
+func (srv *Server) ForcedClosed() int {
+	return int(atomic.LoadInt64(&srv.forcedClosed))
+}
+
+// connTracker 通过ConnState记录未关闭的连接
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[net.Conn]http.ConnState),
+	}
+}
+
+func (ct *connTracker) track(c net.Conn, state http.ConnState) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(ct.conns, c)
+	default:
+		ct.conns[c] = state
+	}
+}
+
+func (ct *connTracker) len() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.conns)
+}
+
+// shutdown 依次执行：BeforeShutdown注册的方法，
+// ready置为false并等待drainTime(ctx先结束时不再等待)，停止接收新请求并等待处理中的请求直到ctx结束，
+// 超时后强制关闭剩余连接，再等待异步任务，最后执行AfterShutdown，
+// ctx为nil时drain之后最多等待shutdownTime
+func (srv *Server) shutdown(ctx context.Context) (err error) {
+	srv.hooks.run(&srv.hooks.beforeShutdown)
+
+	if ctx == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), srv.drainTime+srv.shutdownTime)
+		defer cancel()
+	}
+
+	atomic.StoreInt32(&srv.ready, 0)
+	if srv.drainTime > 0 {
+		GetLogger().Info("utils.Server draining", "drain_time", srv.drainTime)
+		timer := time.NewTimer(srv.drainTime)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	var forced int64
+	var wg sync.WaitGroup
+	for _, sl := range srv.listeners {
+		wg.Add(1)
+		go func(sl *serverListener) {
+			defer wg.Done()
+			if err := sl.server.Shutdown(ctx); err == nil {
+				return
+			}
+
+			n := sl.conns.len()
+			sl.server.Close()
+			atomic.AddInt64(&forced, int64(n))
+			GetLogger().Warn("utils.Server shutdown timeout, connections forcibly closed", "listener", sl.conf.Name, "conns", n)
+		}(sl)
+	}
+	wg.Wait()
+	atomic.StoreInt64(&srv.forcedClosed, forced)
+
+	remain := 0
+	if !srv.noAsyncTaskShutdown {
+		timeout := srv.shutdownTime
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			timeout = time.Millisecond
+		}
+		_, remain, _ = AsyncTaskShutdown(timeout)
+	}
+	GetLogger().Info("utils.Server shutdown", "forced_conns", forced, "async_task_remain", remain)
+
+	srv.removePidFile()
+	srv.hooks.run(&srv.hooks.afterShutdown)
+
+	if forced > 0 || remain > 0 {
+		err = fmt.Errorf("shutdown timeout, forced conns: %d, async task remain: %d", forced, remain)
+	}
+	return
+}
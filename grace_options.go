@@ -0,0 +1,250 @@
+// 此文件定义grace Server的选项及连接数限制
+
+package utils
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShutdownTime  = time.Millisecond * 800
+	defaultStartTime     = time.Millisecond * 200
+	defaultServerTimeout = time.Minute * 10
+)
+
+// ServerOption Server选项，用于NewServerWithOptions
+type ServerOption func(*Server)
+
+// WithShutdownTime 退出时等待处理中请求的最长时间
+func WithShutdownTime(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.shutdownTime = d
+	}
+}
+
+// WithStartTime graceful restart时子进程就绪后老进程停止前的等待时长
+func WithStartTime(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.startTime = d
+	}
+}
+
+// WithReadyTimeout 同SetReadyTimeout
+func WithReadyTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.readyTimeout = d
+	}
+}
+
+// WithDrainTime 同SetDrainTime
+func WithDrainTime(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.drainTime = d
+	}
+}
+
+// WithTimeout 同时设置ReadTimeout及WriteTimeout
+func WithTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.server.ReadTimeout = d
+		srv.server.WriteTimeout = d
+	}
+}
+
+func WithReadTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.server.ReadTimeout = d
+	}
+}
+
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.server.WriteTimeout = d
+	}
+}
+
+func WithReadHeaderTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.server.ReadHeaderTimeout = d
+	}
+}
+
+// WithIdleTimeout keep-alive连接的空闲超时
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.server.IdleTimeout = d
+	}
+}
+
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(srv *Server) {
+		srv.server.MaxHeaderBytes = n
+	}
+}
+
+func WithErrorLog(l *log.Logger) ServerOption {
+	return func(srv *Server) {
+		srv.server.ErrorLog = l
+	}
+}
+
+// WithConnState 连接状态变化时回调，所有监听共用
+func WithConnState(f func(net.Conn, http.ConnState)) ServerOption {
+	return func(srv *Server) {
+		srv.server.ConnState = f
+	}
+}
+
+// WithKeepAlives 是否启用keep-alive，默认启用
+func WithKeepAlives(enabled bool) ServerOption {
+	return func(srv *Server) {
+		srv.noKeepAlives = !enabled
+	}
+}
+
+// WithMaxConns 每个监听最多同时处理n个连接，超过时暂停accept，0为不限制
+func WithMaxConns(n int) ServerOption {
+	return func(srv *Server) {
+		srv.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP 每个监听上单个ip最多n个连接，超过时新连接直接关闭，0为不限制
+func WithMaxConnsPerIP(n int) ServerOption {
+	return func(srv *Server) {
+		srv.maxConnsPerIP = n
+	}
+}
+
+// limitListener 按WithMaxConns及WithMaxConnsPerIP限制连接数，
+// 返回的listener只用于serve，graceful restart时传给子进程的仍是原始listener
+func (srv *Server) limitListener(l net.Listener) net.Listener {
+	if srv.maxConns <= 0 && srv.maxConnsPerIP <= 0 {
+		return l
+	}
+
+	ll := &limitListener{
+		Listener: l,
+		perIP:    srv.maxConnsPerIP,
+		ips:      make(map[string]int),
+		done:     make(chan struct{}),
+	}
+	if srv.maxConns > 0 {
+		ll.sem = make(chan struct{}, srv.maxConns)
+	}
+	return ll
+}
+
+type limitListener struct {
+	net.Listener
+	sem   chan struct{}
+	perIP int
+
+	mu        sync.Mutex
+	ips       map[string]int
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *limitListener) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if !l.acquire() {
+			return nil, net.ErrClosed
+		}
+
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+
+		ip := connIP(c)
+		if !l.addIP(ip) {
+			c.Close()
+			l.release()
+			continue
+		}
+		return &limitConn{Conn: c, l: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) addIP(ip string) bool {
+	if l.perIP <= 0 || ip == "" {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ips[ip] >= l.perIP {
+		return false
+	}
+	l.ips[ip]++
+	return true
+}
+
+func (l *limitListener) removeIP(ip string) {
+	if l.perIP <= 0 || ip == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return err
+}
+
+// connIP 返回连接的对端ip，unix socket时为空，不受WithMaxConnsPerIP限制
+func connIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+type limitConn struct {
+	net.Conn
+	l         *limitListener
+	ip        string
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.l.removeIP(c.ip)
+		c.l.release()
+	})
+	return err
+}
@@ -0,0 +1,122 @@
+// 此文件定义grace Server的pid文件，graceful restart后pid文件由子进程更新，
+// 运维脚本可通过Reload、Stop向当前进程发送信号
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WithPidFile 开始服务后将pid写入path，graceful restart时子进程就绪后更新，
+// lock为true时同时对path.lock加锁，防止同时启动多个主进程，锁会传给子进程
+func WithPidFile(path string, lock bool) ServerOption {
+	return func(srv *Server) {
+		srv.pidFile = path
+		srv.pidLock = lock
+	}
+}
+
+// gracefulLockEnv 用于告诉子进程pid锁文件的fd
+func gracefulLockEnv() string {
+	return filepath.Base(os.Args[0]) + "_GRACEFUL_LOCK"
+}
+
+// lockPidFile 获取pid锁，graceful restart的子进程直接使用父进程传来的锁
+func (srv *Server) lockPidFile() (err error) {
+	if srv.pidFile == "" || !srv.pidLock {
+		return
+	}
+
+	if v, ok := os.LookupEnv(gracefulLockEnv()); ok && srv.isGraceful {
+		os.Unsetenv(gracefulLockEnv())
+		if fd, e := strconv.Atoi(v); e == nil {
+			srv.lockFile = os.NewFile(uintptr(fd), "lock")
+			return
+		}
+	}
+
+	f, err := os.OpenFile(srv.pidFile+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	if err = flock(f, true, true); err != nil {
+		f.Close()
+		pid, _ := ReadPidFile(srv.pidFile)
+		return fmt.Errorf("pid file %s locked by another process, pid: %d: %v", srv.pidFile, pid, err)
+	}
+	srv.lockFile = f
+	return
+}
+
+// writePidFile 先写临时文件再rename，保证读到的总是完整的pid
+func (srv *Server) writePidFile() {
+	if srv.pidFile == "" {
+		return
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", srv.pidFile, os.Getpid())
+	err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, srv.pidFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		GetLogger().Error("utils.Server write pid file failed", "path", srv.pidFile, "err", err)
+	}
+}
+
+// removePidFile 退出时删除pid文件，已被子进程更新时不删除，
+// 关闭锁文件后如果子进程还持有锁，锁不会释放
+func (srv *Server) removePidFile() {
+	if srv.pidFile != "" {
+		if pid, err := ReadPidFile(srv.pidFile); err == nil && pid == os.Getpid() {
+			os.Remove(srv.pidFile)
+		}
+	}
+	if srv.lockFile != nil {
+		srv.lockFile.Close()
+		srv.lockFile = nil
+	}
+}
+
+// ReadPidFile 读取pid文件
+func ReadPidFile(path string) (pid int, err error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(bs)))
+	return
+}
+
+func signalPidFile(path string, sig os.Signal) (err error) {
+	pid, err := ReadPidFile(path)
+	if err != nil {
+		return
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	if err = p.Signal(sig); err != nil {
+		err = fmt.Errorf("signal pid %d: %v", pid, err)
+	}
+	return
+}
+
+// Reload 向pid文件对应的进程发送SIGHUP，触发graceful restart
+func Reload(pidfile string) error {
+	return signalPidFile(pidfile, syscall.SIGHUP)
+}
+
+// Stop 向pid文件对应的进程发送SIGTERM
+func Stop(pidfile string) error {
+	return signalPidFile(pidfile, syscall.SIGTERM)
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// certReloadSignal 收到此信号时重新加载证书，不重启进程
+var certReloadSignal os.Signal = syscall.SIGUSR1
+
+// setNonblock 将监听恢复为非阻塞模式，exec.Cmd传递ExtraFiles时会通过File.Fd()将其设为阻塞模式，
+// 与监听共享同一个打开的文件描述，监听阻塞在accept里时退出会一直等待新连接
+func setNonblock(l net.Listener) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var e error
+	if err = rc.Control(func(fd uintptr) {
+		e = syscall.SetNonblock(int(fd), true)
+	}); err != nil {
+		return err
+	}
+	return e
+}
@@ -0,0 +1,13 @@
+package utils
+
+import (
+	"net"
+	"os"
+)
+
+// windows下不支持通过信号重新加载证书
+var certReloadSignal os.Signal
+
+func setNonblock(l net.Listener) error {
+	return nil
+}
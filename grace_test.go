@@ -0,0 +1,564 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, handler http.Handler, opts ...ServerOption) *Server {
+	opts = append([]ServerOption{WithShutdownTime(time.Second), WithStartTime(0), WithTimeout(time.Second)}, opts...)
+	srv := NewServerWithOptions("127.0.0.1:0", handler, opts...)
+	srv.DisableSignals()
+	srv.SkipAsyncTaskShutdown()
+
+	ready := make(chan bool)
+	srv.OnReady(func() { close(ready) })
+	go srv.ListenAndServe()
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("server not ready")
+	}
+	return srv
+}
+
+func TestServerShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var seq []string
+	record := func(s string) func() {
+		return func() {
+			mu.Lock()
+			seq = append(seq, s)
+			mu.Unlock()
+		}
+	}
+
+	srv := NewServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), time.Second, 0, time.Second)
+	srv.DisableSignals()
+	srv.SkipAsyncTaskShutdown()
+	srv.OnStart(record("start"))
+	srv.OnReady(record("ready"))
+	srv.BeforeShutdown(record("before"))
+	srv.AfterShutdown(record("after"))
+	go srv.ListenAndServe()
+
+	waitFor(t, srv.Ready)
+
+	resp, err := http.Get("http://" + srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body: %s", body)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server not done")
+	}
+
+	if srv.Ready() {
+		t.Error("server should not be ready after shutdown")
+	}
+	if got := strings.Join(seq, ","); got != "start,ready,before,after" {
+		t.Errorf("hooks: %s", got)
+	}
+	if err := srv.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Errorf("second shutdown: %v", err)
+	}
+}
+
+func TestServerShutdownForced(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	go http.Get("http://" + srv.Addr().String())
+	waitFor(t, func() bool {
+		return srv.listeners[0].conns.len() == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		t.Error("shutdown should report forced conns")
+	}
+	if n := srv.ForcedClosed(); n != 1 {
+		t.Errorf("forced closed: %d", n)
+	}
+}
+
+func TestServerReadyHandler(t *testing.T) {
+	srv := startTestServer(t, nil)
+	h := srv.ReadyHandler()
+
+	get := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Errorf("ready code: %d", code)
+	}
+	srv.Shutdown(context.Background())
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("shutdown code: %d", code)
+	}
+}
+
+func TestServerMaxConnsPerIP(t *testing.T) {
+	srv := startTestServer(t, nil, WithMaxConnsPerIP(1))
+	defer srv.Shutdown(context.Background())
+
+	c1, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	waitFor(t, func() bool {
+		return srv.listeners[0].conns.len() == 1
+	})
+
+	c2, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("second conn should be closed, err: %v", err)
+	}
+
+	// 第一个连接关闭后可以再次连接
+	c1.Close()
+	waitFor(t, func() bool {
+		return srv.listeners[0].conns.len() == 0
+	})
+	resp, err := http.Get("http://" + srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerPidFile(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "server.pid")
+	srv := startTestServer(t, nil, WithPidFile(pidfile, true))
+
+	if pid, err := ReadPidFile(pidfile); err != nil || pid != os.Getpid() {
+		t.Fatalf("pid: %d, err: %v", pid, err)
+	}
+
+	other := NewServerWithOptions("127.0.0.1:0", nil, WithPidFile(pidfile, true))
+	other.DisableSignals()
+	if err := other.ListenAndServe(); err == nil {
+		t.Error("second server should fail to lock pid file")
+	}
+
+	srv.Shutdown(context.Background())
+	if _, err := os.Stat(pidfile); !os.IsNotExist(err) {
+		t.Errorf("pid file should be removed, err: %v", err)
+	}
+}
+
+func TestServerListenerName(t *testing.T) {
+	srv := NewServerWithOptions("127.0.0.1:0", nil)
+	for _, name := range []string{"", "a,b", "a:b", DefaultListenerName} {
+		if err := srv.AddListener(&ListenerConf{Name: name, Addr: "127.0.0.1:0"}); err == nil {
+			t.Errorf("listener name %q accepted", name)
+		}
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+
+	// 仍在监听的socket不会被删除
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewServerWithOptions("127.0.0.1:0", nil)
+	other.DisableSignals()
+	other.AddListener(&ListenerConf{Name: "unix", Network: "unix", Addr: path})
+	if err := other.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("listen on live socket: %v", err)
+	}
+
+	// 遗留的socket文件会被删除后重新监听
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix"))
+	}), func(srv *Server) {
+		srv.AddListener(&ListenerConf{Name: "unix", Network: "unix", Addr: path})
+	})
+	defer srv.Shutdown(context.Background())
+
+	if body := getUnix(t, path); body != "unix" {
+		t.Fatalf("body: %s", body)
+	}
+}
+
+func getUnix(t *testing.T, path string) string {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+// startGracefulChild 以graceful restart子进程的方式运行当前测试二进制里的name用例，
+// files依次作为继承的监听，返回子进程及就绪管道
+func startGracefulChild(t *testing.T, name, mode string, manifest []string, files []*os.File) (*exec.Cmd, *os.File) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyW.Close()
+
+	base := filepath.Base(os.Args[0])
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"UTILS_TEST_GRACE_CHILD="+mode,
+		base+"_GRACEFUL=true",
+		base+"_GRACEFUL_LISTENERS="+strings.Join(manifest, ","),
+		base+"_GRACEFUL_READY="+strconv.Itoa(3+len(files)),
+	)
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		readyR.Close()
+		t.Fatal(err)
+	}
+	return cmd, readyR
+}
+
+func TestServerInheritListeners(t *testing.T) {
+	if os.Getenv("UTILS_TEST_GRACE_CHILD") == "inherit" {
+		srv := NewServerWithOptions("127.0.0.1:1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("default"))
+		}))
+		srv.DisableSignals()
+		srv.SkipAsyncTaskShutdown()
+		// 继承时不使用Addr
+		srv.AddListener(&ListenerConf{Name: "admin", Network: "unix", Addr: "/nonexistent/admin.sock", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("admin"))
+		})})
+		srv.ListenAndServe()
+		return
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ul, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	tf, _ := tl.(*net.TCPListener).File()
+	uf, _ := ul.(*net.UnixListener).File()
+	cmd, readyR := startGracefulChild(t, "TestServerInheritListeners", "inherit", []string{"admin:4", "default:3"}, []*os.File{tf, uf})
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	defer readyR.Close()
+	tf.Close()
+	uf.Close()
+	tl.Close()
+	ul.Close()
+
+	readyC := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := readyR.Read(buf)
+		readyC <- n == 1
+	}()
+	select {
+	case ok := <-readyC:
+		if !ok {
+			t.Fatal("child closed ready pipe")
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("child not ready")
+	}
+
+	resp, err := http.Get("http://" + tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "default" {
+		t.Fatalf("default body: %s", body)
+	}
+	if body := getUnix(t, path); body != "admin" {
+		t.Fatalf("admin body: %s", body)
+	}
+}
+
+func TestServerWaitReady(t *testing.T) {
+	switch os.Getenv("UTILS_TEST_GRACE_CHILD") {
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		return
+	case "close":
+		os.NewFile(3, "ready").Close()
+		time.Sleep(time.Minute)
+		return
+	case "ready":
+		NewServerWithOptions("127.0.0.1:0", nil).notifyReady()
+		time.Sleep(time.Minute)
+		return
+	}
+
+	srv := NewServerWithOptions("127.0.0.1:0", nil)
+	srv.SetReadyTimeout(time.Millisecond * 500)
+	for mode, want := range map[string]string{
+		"exit":  "exited before ready",
+		"hang":  "not ready in",
+		"close": "closed ready pipe without notify",
+		"ready": "",
+	} {
+		cmd, readyR := startGracefulChild(t, "TestServerWaitReady", mode, nil, nil)
+		err := srv.waitReady(cmd, readyR)
+		readyR.Close()
+		if want == "" {
+			// 就绪后子进程由waitReady里的goroutine回收
+			cmd.Process.Kill()
+			if err != nil {
+				t.Errorf("%s: %v", mode, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v", mode, err)
+		}
+		// 超时的子进程已被杀掉并回收
+		if cmd.ProcessState == nil {
+			t.Errorf("%s: child not reaped", mode)
+		}
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	var mu sync.Mutex
+	var seq []string
+	record := func(s string) {
+		mu.Lock()
+		seq = append(seq, s)
+		mu.Unlock()
+	}
+
+	var srv *Server
+	started, release := make(chan bool), make(chan bool)
+	srv = startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			srv.ReadyHandler().ServeHTTP(w, r)
+		case "/slow":
+			close(started)
+			<-release
+			record("slow")
+		}
+	}), WithDrainTime(time.Millisecond*300), WithShutdownTime(time.Second*5))
+	srv.BeforeShutdown(func() { record("before") })
+	srv.AfterShutdown(func() { record("after") })
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(path string) int {
+		resp, err := client.Get("http://" + srv.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	go client.Get("http://" + srv.Addr().String() + "/slow")
+	<-started
+
+	shutdownC := make(chan error, 1)
+	go func() {
+		shutdownC <- srv.Shutdown(context.Background())
+	}()
+
+	// drain期间readiness失败，但仍接收新请求
+	waitFor(t, func() bool { return !srv.Ready() })
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("ready code during drain: %d", code)
+	}
+	if code := get("/"); code != http.StatusOK {
+		t.Errorf("code during drain: %d", code)
+	}
+	record("drain")
+
+	// drain结束后等待处理中的请求完成
+	time.Sleep(time.Millisecond * 400)
+	select {
+	case err := <-shutdownC:
+		t.Fatalf("shutdown returned before in-flight request: %v", err)
+	default:
+	}
+	close(release)
+	if err := <-shutdownC; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(seq, ","); got != "before,drain,slow,after" {
+		t.Errorf("order: %s", got)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	switch os.Getenv("UTILS_TEST_GRACE_CHILD") {
+	case "restart-fail":
+		os.Exit(1)
+	case "restart-ready":
+		srv := NewServerWithOptions("127.0.0.1:1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("child:" + strconv.Itoa(os.Getpid())))
+		}))
+		srv.DisableSignals()
+		srv.SkipAsyncTaskShutdown()
+		time.AfterFunc(time.Minute, func() { os.Exit(0) })
+		srv.ListenAndServe()
+		return
+	}
+
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("parent"))
+	}), WithReadyTimeout(time.Second*10))
+	defer srv.Shutdown(context.Background())
+
+	get := func() string {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + srv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// 子进程只运行此用例
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestServerRestart$"}
+	defer func() { os.Args = args }()
+
+	// 子进程就绪前退出时回滚，老进程继续服务
+	t.Setenv("UTILS_TEST_GRACE_CHILD", "restart-fail")
+	if err := srv.Restart(); err == nil || !strings.Contains(err.Error(), "exited before ready") {
+		t.Fatalf("restart with failing child: %v", err)
+	}
+	if !srv.Ready() {
+		t.Fatal("parent not ready after rollback")
+	}
+	if body := get(); body != "parent" {
+		t.Fatalf("body after rollback: %s", body)
+	}
+
+	// 子进程就绪后接管监听，老进程退出
+	t.Setenv("UTILS_TEST_GRACE_CHILD", "restart-ready")
+	if err := srv.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("parent not done after restart")
+	}
+
+	body := get()
+	if !strings.HasPrefix(body, "child:") {
+		t.Fatalf("body after restart: %s", body)
+	}
+	if pid, err := strconv.Atoi(strings.TrimPrefix(body, "child:")); err == nil {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	}
+}
+
+func TestServerDrainDeadline(t *testing.T) {
+	srv := startTestServer(t, nil, WithDrainTime(time.Second*10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	bt := time.Now()
+	srv.Shutdown(ctx)
+	if d := time.Since(bt); d > time.Second*2 {
+		t.Fatalf("shutdown ignored ctx deadline during drain: %v", d)
+	}
+}
+
+func TestServerControl(t *testing.T) {
+	// 还未调用ListenAndServe时立即返回ErrServerClosed
+	srv := NewServerWithOptions("127.0.0.1:0", nil)
+	srv.DisableSignals()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != ErrServerClosed {
+		t.Fatalf("shutdown before serve: %v", err)
+	}
+	if err := srv.Restart(); err != ErrServerClosed {
+		t.Fatalf("restart before serve: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("shutdown before serve waited for ctx")
+	}
+
+	// 退出后返回ErrServerClosed
+	srv = startTestServer(t, nil)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-srv.Done()
+	if err := srv.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Fatalf("shutdown after exit: %v", err)
+	}
+	if err := srv.Restart(); err != ErrServerClosed {
+		t.Fatalf("restart after exit: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// 此文件定义grace Server的TLS支持，证书文件可通过信号热加载
+
+package utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// certReloader 从文件加载证书，reload失败时继续使用旧证书
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (cr *certReloader, err error) {
+	cr = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err = cr.reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// tlsConfig 返回启用http/2的tls配置，certFile不为空时证书由certReloader提供
+func tlsConfig(conf *ListenerConf) (config *tls.Config, cr *certReloader, err error) {
+	if conf.TLSConfig == nil && conf.CertFile == "" {
+		return
+	}
+
+	if conf.TLSConfig != nil {
+		config = conf.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if conf.CertFile != "" {
+		if cr, err = newCertReloader(conf.CertFile, conf.KeyFile); err != nil {
+			return
+		}
+		config.GetCertificate = cr.GetCertificate
+	}
+
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return
+}
+
+// ReloadCertificates 重新加载所有通过证书文件配置的TLS监听的证书，
+// 非windows下收到SIGUSR1时也会调用
+func (srv *Server) ReloadCertificates() error {
+	var errs MultiError
+	for _, sl := range srv.listeners {
+		if sl.certReloader == nil {
+			continue
+		}
+		if err := sl.certReloader.reload(); err != nil {
+			GetLogger().Error("utils.Server reload certificate failed", "listener", sl.conf.Name, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		GetLogger().Info("utils.Server certificate reloaded", "listener", sl.conf.Name)
+	}
+	return errs.ErrorOrNil()
+}
+
+// WithTLSFiles 默认监听使用certFile及keyFile启用TLS及http/2，证书可通过ReloadCertificates热加载
+func WithTLSFiles(certFile, keyFile string) ServerOption {
+	return func(srv *Server) {
+		srv.defaultConf.CertFile = certFile
+		srv.defaultConf.KeyFile = keyFile
+	}
+}
+
+// WithTLSConfig 默认监听使用config启用TLS，未设置NextProtos时启用http/2
+func WithTLSConfig(config *tls.Config) ServerOption {
+	return func(srv *Server) {
+		srv.defaultConf.TLSConfig = config
+	}
+}
+
+// NewTLSServer 同NewServer，默认监听使用certFile及keyFile启用TLS及http/2
+func NewTLSServer(addr, certFile, keyFile string, handler http.Handler, shutdownTime, startTime, timeout time.Duration) (*Server, error) {
+	return newTLSServer(addr, handler, shutdownTime, startTime, timeout, WithTLSFiles(certFile, keyFile))
+}
+
+// NewTLSServerWithConfig 同NewServer，默认监听使用config启用TLS及http/2
+func NewTLSServerWithConfig(addr string, config *tls.Config, handler http.Handler, shutdownTime, startTime, timeout time.Duration) (*Server, error) {
+	return newTLSServer(addr, handler, shutdownTime, startTime, timeout, WithTLSConfig(config))
+}
+
+func newTLSServer(addr string, handler http.Handler, shutdownTime, startTime, timeout time.Duration, opt ServerOption) (*Server, error) {
+	srv := NewServerWithOptions(addr, handler,
+		WithShutdownTime(shutdownTime),
+		WithStartTime(startTime),
+		WithTimeout(timeout),
+		opt,
+	)
+	if srv.initErr != nil {
+		return nil, srv.initErr
+	}
+	return srv, nil
+}
+
+func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
+	shutdownTime, startTime, timeout := defaultShutdownTime, defaultStartTime, defaultServerTimeout
+	srv, err := NewTLSServer(addr, certFile, keyFile, handler, shutdownTime, startTime, timeout)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
+
+func ListenAndServeTLSWithConfig(addr string, config *tls.Config, handler http.Handler) error {
+	shutdownTime, startTime, timeout := defaultShutdownTime, defaultStartTime, defaultServerTimeout
+	srv, err := NewTLSServerWithConfig(addr, config, handler, shutdownTime, startTime, timeout)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
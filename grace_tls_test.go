@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成CommonName为cn的自签名证书写入certFile及keyFile
+func writeTestCert(t *testing.T, cn, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, "a", certFile, keyFile)
+
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), func(srv *Server) {
+		if err := srv.AddListener(&ListenerConf{Name: "tls", Addr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer srv.Shutdown(context.Background())
+
+	// 每次新建连接，以便看到reload后的证书
+	get := func() (proto, cn string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get("https://" + srv.ListenerAddr("tls").String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if proto, cn := get(); proto != "HTTP/2.0" || cn != "a" {
+		t.Fatalf("proto: %s, cn: %s", proto, cn)
+	}
+
+	writeTestCert(t, "b", certFile, keyFile)
+	if err := srv.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if _, cn := get(); cn != "b" {
+		t.Fatalf("cn after reload: %s", cn)
+	}
+
+	// reload失败时继续使用旧证书
+	ioutil.WriteFile(keyFile, []byte("bad"), 0600)
+	if err := srv.ReloadCertificates(); err == nil {
+		t.Fatal("reload bad key should fail")
+	}
+	if _, cn := get(); cn != "b" {
+		t.Fatalf("cn after failed reload: %s", cn)
+	}
+}
+
+func TestServerTLSOption(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := NewTLSServer("127.0.0.1:0", certFile, keyFile, nil, time.Second, 0, time.Second); err == nil {
+		t.Fatal("missing cert file accepted")
+	}
+
+	writeTestCert(t, "a", certFile, keyFile)
+	srv := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), WithTLSFiles(certFile, keyFile))
+	defer srv.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("https://" + srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "HTTP/2.0" {
+		t.Fatalf("proto: %s", body)
+	}
+}
@@ -171,7 +171,11 @@ func sendHttpRequest(method string, gpp *GPP) (body []byte, err error) {
 		client.Transport = httpTransport
 	}
 
+	bt := time.Now()
 	resp, err := client.Do(req)
+	defer func() {
+		observeHTTPClient(req.URL.Host, resp, bt)
+	}()
 	if resp != nil {
 		defer resp.Body.Close()
 	}
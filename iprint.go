@@ -6,7 +6,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 )
@@ -92,7 +91,7 @@ func IprintD(a ...interface{}) {
 	for _, v := range a {
 		bs, err := json.Marshal(obj2json(v))
 		if err != nil {
-			log.Println(err)
+			GetLogger().Error("utils.IprintD error", "err", err)
 			return
 		}
 		fmt.Println(string(bs))
@@ -0,0 +1,734 @@
+// 此文件定义基于本地append-only文件的持久化任务队列，至少投递一次(at-least-once)
+// 未ack的任务在进程重启后会被重新投递，graceful restart期间新老进程共享同一队列文件
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	jobOpEnqueue = "enq"
+	jobOpRetry   = "retry"
+	jobOpAck     = "ack"
+	jobOpDead    = "dead"
+
+	jobLogFile  = "queue.log"
+	jobDeadFile = "dead.log"
+	jobLockFile = "LOCK"
+)
+
+var ErrJobQueueClosed = errors.New("job queue closed")
+
+// Job 持久化任务
+type Job struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Payload  []byte    `json:"payload,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+	NextAt   time.Time `json:"next_at"`
+	Err      string    `json:"err,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// JobHandler 任务处理方法，返回error时任务会按backoff重试
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobQueueConf 持久化任务队列配置
+type JobQueueConf struct {
+	Dir          string        // 队列文件所在目录
+	Workers      int           // 并发处理数，<=0时为1
+	MaxAttempts  int           // 最大尝试次数，超过后进入死信，<=0时为5
+	Backoff      time.Duration // 首次重试间隔，之后每次翻倍，<=0时为1秒
+	MaxBackoff   time.Duration // 重试间隔上限，<=0时为10分钟
+	ScanInterval time.Duration // 读取其它进程写入记录的间隔，<=0时为1秒
+	NoSync       bool          // 写入后不fsync，性能更好但掉电时可能丢任务
+	// CompactThreshold 队列文件记录数超过此值且超过未ack任务数的2倍时，
+	// 在没有其它进程使用此队列时compact，<=0时为10000
+	CompactThreshold int
+}
+
+type jobRecord struct {
+	Op  string `json:"op"`
+	ID  string `json:"id,omitempty"`
+	Job *Job   `json:"job,omitempty"`
+}
+
+// JobQueue 持久化任务队列
+type JobQueue struct {
+	conf JobQueueConf
+
+	mu       sync.Mutex
+	lock     *os.File
+	file     *os.File
+	offset   int64
+	records  int // 队列文件中的记录数
+	pending  map[string]*Job
+	running  map[string]bool
+	handlers map[string]JobHandler
+	started  bool
+	closed   bool
+
+	ctx    context.Context // AsyncTaskShutdown或Close时cancel
+	cancel context.CancelFunc
+	notify chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+var jobSeq int64
+
+// OpenJobQueue 打开(或创建)持久化任务队列，并恢复上次未ack的任务，
+// 末尾不完整的记录(写入时进程退出)会被丢弃
+func OpenJobQueue(conf *JobQueueConf) (q *JobQueue, err error) {
+	c := *conf
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = time.Minute * 10
+	}
+	if c.ScanInterval <= 0 {
+		c.ScanInterval = time.Second
+	}
+	if c.CompactThreshold <= 0 {
+		c.CompactThreshold = 10000
+	}
+
+	if err = os.MkdirAll(c.Dir, 0755); err != nil {
+		return
+	}
+
+	lock, err := os.OpenFile(filepath.Join(c.Dir, jobLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+
+	q = &JobQueue{
+		conf:     c,
+		lock:     lock,
+		pending:  make(map[string]*Job),
+		running:  make(map[string]bool),
+		handlers: make(map[string]JobHandler),
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	q.ctx, q.cancel = context.WithCancel(asyncTaskCtx)
+	defer func() {
+		if err != nil {
+			q.cancel()
+		}
+	}()
+
+	// 没有其它进程使用此队列时才compact，compact只保留完整的记录，即截掉了末尾不完整的记录
+	if flock(lock, true, true) == nil {
+		err = q.compact()
+		funlock(lock)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+	}
+	if err = flock(lock, false, false); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	q.file, err = os.OpenFile(filepath.Join(c.Dir, jobLogFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	if err = q.tail(); err == nil {
+		err = q.terminateTail()
+	}
+	if err != nil {
+		q.file.Close()
+		lock.Close()
+		return nil, err
+	}
+	return
+}
+
+// terminateTail 有其它进程使用此队列而无法compact时，末尾不完整的记录不能截掉(可能正在写入)，
+// 补一个换行使之后追加的记录另起一行，不完整的记录会被当作错误记录跳过，
+// 如果是其它进程正在写入的记录，换行会追加在其后成为空行，调用者需持有q.mu
+func (q *JobQueue) terminateTail() (err error) {
+	fi, err := q.file.Stat()
+	if err != nil || fi.Size() <= q.offset {
+		return
+	}
+
+	GetLogger().Warn("utils.JobQueue terminate torn record", "dir", q.conf.Dir, "size", fi.Size(), "valid", q.offset)
+	_, err = q.file.Write([]byte{'\n'})
+	return
+}
+
+// Handle 注册name对应的处理方法，没有处理方法的任务会一直保留在队列里
+func (q *JobQueue) Handle(name string, h JobHandler) {
+	q.mu.Lock()
+	q.handlers[name] = h
+	q.mu.Unlock()
+	q.wakeup()
+}
+
+// Start 启动worker，AsyncTaskShutdown时停止获取新任务，处理中的任务计入异步任务数
+func (q *JobQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started || q.closed {
+		return
+	}
+	q.started = true
+
+	for i := 0; i < q.conf.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	go func() {
+		select {
+		case <-AsyncTaskChan:
+			q.shutdown()
+		case <-q.stop:
+		}
+	}()
+}
+
+// Enqueue 持久化任务后返回任务id
+func (q *JobQueue) Enqueue(name string, payload []byte) (id string, err error) {
+	now := time.Now()
+	job := &Job{
+		ID:      fmt.Sprintf("%d-%d-%d", now.UnixNano(), os.Getpid(), atomic.AddInt64(&jobSeq, 1)),
+		Name:    name,
+		Payload: payload,
+		NextAt:  now,
+		Created: now,
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		err = ErrJobQueueClosed
+		return
+	}
+	err = q.append(&jobRecord{Op: jobOpEnqueue, Job: job})
+	if err == nil {
+		q.pending[job.ID] = job
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	q.wakeup()
+	id = job.ID
+	return
+}
+
+// Pending 返回未ack的任务数
+func (q *JobQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// DeadJobs 返回死信里的任务
+func (q *JobQueue) DeadJobs() (jobs []*Job, err error) {
+	f, err := os.Open(filepath.Join(q.conf.Dir, jobDeadFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	if err = flock(f, false, false); err != nil {
+		return
+	}
+	defer funlock(f)
+
+	return readDeadJobs(f)
+}
+
+func readDeadJobs(f *os.File) (jobs []*Job, err error) {
+	_, err = readJobRecords(f, func(record *jobRecord) {
+		if record.Job != nil {
+			jobs = append(jobs, record.Job)
+		}
+	})
+	return
+}
+
+// RequeueDead 将死信里的任务重新入队(尝试次数清零)，并清空死信，
+// 读取及清空期间持有死信文件的锁，期间其它进程写入的死信会等待
+func (q *JobQueue) RequeueDead() (n int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		err = ErrJobQueueClosed
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(q.conf.Dir, jobDeadFile), os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	if err = flock(f, true, false); err != nil {
+		return
+	}
+	defer funlock(f)
+
+	jobs, err := readDeadJobs(f)
+	if err != nil {
+		return
+	}
+
+	for _, job := range jobs {
+		job.Attempts, job.Err, job.NextAt = 0, "", time.Now()
+		if err = q.append(&jobRecord{Op: jobOpEnqueue, Job: job}); err != nil {
+			return
+		}
+		q.pending[job.ID] = job
+		n++
+	}
+
+	err = f.Truncate(0)
+	q.wakeup()
+	return
+}
+
+// Close 停止worker，cancel处理中任务的ctx并等待其结束后关闭队列文件
+func (q *JobQueue) Close() (err error) {
+	q.shutdown()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	err = q.file.Close()
+	funlock(q.lock)
+	if flock(q.lock, true, true) == nil {
+		if e := q.compact(); e != nil && err == nil {
+			err = e
+		}
+		funlock(q.lock)
+	}
+	q.lock.Close()
+	return
+}
+
+func (q *JobQueue) shutdown() {
+	q.once.Do(func() {
+		close(q.stop)
+		q.cancel()
+	})
+}
+
+func (q *JobQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, h, wait := q.next()
+		if job != nil {
+			q.run(job, h)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.notify:
+		case <-timer.C:
+			q.mu.Lock()
+			q.maybeCompact()
+			q.mu.Unlock()
+		}
+	}
+}
+
+// next 返回下一个可执行的任务，没有时返回需要等待的时间
+func (q *JobQueue) next() (job *Job, h JobHandler, wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	wait = q.conf.ScanInterval
+	for _, j := range q.pending {
+		if q.running[j.ID] {
+			continue
+		}
+		handler, ok := q.handlers[j.Name]
+		if !ok {
+			continue
+		}
+		if d := j.NextAt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		if job == nil || j.NextAt.Before(job.NextAt) {
+			job, h = j, handler
+		}
+	}
+
+	if job != nil {
+		q.running[job.ID] = true
+	}
+	return
+}
+
+func (q *JobQueue) run(job *Job, h JobHandler) {
+	name := "job:" + job.Name
+	asyncTaskEnterNamed(name)
+	defer asyncTaskExitNamed(name)
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+				GetLogger().Error("utils.JobQueue recover", "name", job.Name, "id", job.ID, "err", r, "stack", string(debug.Stack()))
+			}
+		}()
+		return h(q.ctx, job)
+	}()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.ID)
+
+	if _, ok := q.pending[job.ID]; !ok {
+		// 已被其它进程处理
+		return
+	}
+	if err != nil && q.ctx.Err() != nil {
+		// 退出时被cancel，不计入尝试次数，留在队列里重启后重新投递
+		GetLogger().Warn("utils.JobQueue job canceled", "name", job.Name, "id", job.ID, "err", err)
+		return
+	}
+
+	var e error
+	if err == nil {
+		delete(q.pending, job.ID)
+		e = q.append(&jobRecord{Op: jobOpAck, ID: job.ID})
+	} else {
+		retry := *job
+		retry.Attempts++
+		retry.Err = err.Error()
+		if retry.Attempts >= q.conf.MaxAttempts {
+			GetLogger().Error("utils.JobQueue dead job", "name", job.Name, "id", job.ID, "attempts", retry.Attempts, "err", err)
+			delete(q.pending, job.ID)
+			if e = appendJobRecord(filepath.Join(q.conf.Dir, jobDeadFile), &jobRecord{Op: jobOpDead, Job: &retry}, !q.conf.NoSync); e == nil {
+				e = q.append(&jobRecord{Op: jobOpDead, ID: job.ID})
+			}
+		} else {
+			backoff := q.conf.Backoff << uint(retry.Attempts-1)
+			if backoff <= 0 || backoff > q.conf.MaxBackoff {
+				backoff = q.conf.MaxBackoff
+			}
+			retry.NextAt = time.Now().Add(backoff)
+			GetLogger().Warn("utils.JobQueue job failed", "name", job.Name, "id", job.ID, "attempts", retry.Attempts, "backoff", backoff, "err", err)
+			q.pending[job.ID] = &retry
+			e = q.append(&jobRecord{Op: jobOpRetry, Job: &retry})
+		}
+	}
+	if e != nil {
+		GetLogger().Error("utils.JobQueue append error", "dir", q.conf.Dir, "err", e)
+	}
+	q.maybeCompact()
+}
+
+// maybeCompact 读取新记录，已ack的记录过多时compact，需要把共享锁升级为排它锁，
+// 有其它进程使用此队列时跳过，调用者需持有q.mu
+func (q *JobQueue) maybeCompact() {
+	if q.closed {
+		return
+	}
+	// 读取包括自己写入在内的新记录，使记录数准确
+	if err := q.tail(); err != nil {
+		GetLogger().Error("utils.JobQueue tail error", "dir", q.conf.Dir, "err", err)
+		return
+	}
+	if q.records <= q.conf.CompactThreshold || q.records <= 2*len(q.pending) {
+		return
+	}
+
+	// flock升级(及降级)不是原子的，原来的共享锁可能已被释放，其间其它进程可能已compact
+	// 并替换了队列文件，最后总是重新加共享锁，并检查队列文件是否已被替换
+	defer func() {
+		if err := flock(q.lock, false, false); err != nil {
+			GetLogger().Error("utils.JobQueue relock error", "dir", q.conf.Dir, "err", err)
+			return
+		}
+		if err := q.reopenIfReplaced(); err != nil {
+			GetLogger().Error("utils.JobQueue reopen error", "dir", q.conf.Dir, "err", err)
+		}
+	}()
+	if flock(q.lock, true, true) != nil {
+		return
+	}
+
+	// 加锁期间可能有其它进程写入，读完所有记录后compact，内存中的状态与新文件一致
+	if err := q.tail(); err != nil {
+		GetLogger().Error("utils.JobQueue tail error", "dir", q.conf.Dir, "err", err)
+		return
+	}
+	if err := q.compact(); err != nil {
+		GetLogger().Error("utils.JobQueue compact error", "dir", q.conf.Dir, "err", err)
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(q.conf.Dir, jobLogFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		GetLogger().Error("utils.JobQueue reopen error", "dir", q.conf.Dir, "err", err)
+		return
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		GetLogger().Error("utils.JobQueue reopen error", "dir", q.conf.Dir, "err", err)
+		return
+	}
+
+	GetLogger().Info("utils.JobQueue compacted", "dir", q.conf.Dir, "records", q.records, "pending", len(q.pending))
+	q.file.Close()
+	q.file, q.offset, q.records = file, fi.Size(), len(q.pending)
+}
+
+// reopenIfReplaced 队列文件已被其它进程compact替换时，重新打开并从头读取，
+// 否则之后会写入已被删除的老文件，调用者需持有q.mu及共享锁
+func (q *JobQueue) reopenIfReplaced() (err error) {
+	path := filepath.Join(q.conf.Dir, jobLogFile)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	cur, err := q.file.Stat()
+	if err != nil {
+		return
+	}
+	if os.SameFile(fi, cur) {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	GetLogger().Info("utils.JobQueue reopen replaced queue log", "dir", q.conf.Dir)
+	q.file.Close()
+	q.file, q.offset, q.records = file, 0, 0
+	q.pending = make(map[string]*Job)
+	if err = q.tail(); err != nil {
+		return
+	}
+	return q.terminateTail()
+}
+
+func (q *JobQueue) append(record *jobRecord) (err error) {
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if _, err = q.file.Write(append(bs, '\n')); err != nil {
+		return
+	}
+	if !q.conf.NoSync {
+		err = q.file.Sync()
+	}
+	return
+}
+
+// tail 读取文件中尚未读取的记录(包括其它进程写入的)，调用者需持有q.mu
+func (q *JobQueue) tail() (err error) {
+	if _, err = q.file.Seek(q.offset, io.SeekStart); err != nil {
+		return
+	}
+
+	n, err := readJobRecords(q.file, q.apply)
+	q.offset += n
+	return
+}
+
+func (q *JobQueue) apply(record *jobRecord) {
+	q.records++
+	switch record.Op {
+	case jobOpEnqueue, jobOpRetry:
+		if record.Job == nil {
+			return
+		}
+		if job, ok := q.pending[record.Job.ID]; ok && job.Attempts > record.Job.Attempts {
+			return
+		}
+		q.pending[record.Job.ID] = record.Job
+	case jobOpAck, jobOpDead:
+		delete(q.pending, record.ID)
+	}
+}
+
+// compact 重写队列文件，只保留未ack的任务，调用者需持有排它锁
+func (q *JobQueue) compact() (err error) {
+	path := filepath.Join(q.conf.Dir, jobLogFile)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	pending := make(map[string]*Job)
+	var order []string
+	_, err = readJobRecords(f, func(record *jobRecord) {
+		switch record.Op {
+		case jobOpEnqueue, jobOpRetry:
+			if record.Job != nil {
+				if _, ok := pending[record.Job.ID]; !ok {
+					order = append(order, record.Job.ID)
+				}
+				pending[record.Job.ID] = record.Job
+			}
+		case jobOpAck, jobOpDead:
+			delete(pending, record.ID)
+		}
+	})
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(out)
+	for _, id := range order {
+		job, ok := pending[id]
+		if !ok {
+			continue
+		}
+		bs, _ := json.Marshal(&jobRecord{Op: jobOpEnqueue, Job: job})
+		w.Write(bs)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJobRecords 逐行解析记录，返回完整读取的字节数，末尾不完整的行不计入
+func readJobRecords(r io.Reader, fn func(*jobRecord)) (n int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, e := br.ReadBytes('\n')
+		if e != nil {
+			if e != io.EOF {
+				err = e
+			}
+			return
+		}
+		n += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		record := &jobRecord{}
+		if e := json.Unmarshal(line, record); e != nil {
+			GetLogger().Warn("utils.JobQueue skip bad record", "err", e)
+			continue
+		}
+		fn(record)
+	}
+}
+
+// appendJobRecord 加排它锁后追加到path，用于死信文件
+func appendJobRecord(path string, record *jobRecord, sync bool) (err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = flock(f, true, false); err != nil {
+		return
+	}
+	defer funlock(f)
+
+	bs, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(append(bs, '\n')); err != nil {
+		return
+	}
+	if sync {
+		err = f.Sync()
+	}
+	return
+}
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &JobQueueConf{Dir: dir, MaxAttempts: 2, Backoff: time.Millisecond, NoSync: true}
+
+	// 没有handler时任务保留在队列里，重新打开后恢复
+	q, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("ok", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("fail", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Pending(); n != 2 {
+		t.Fatalf("pending after reopen: %d", n)
+	}
+
+	done := make(chan string, 1)
+	q.Handle("ok", func(ctx context.Context, job *Job) error {
+		done <- string(job.Payload)
+		return nil
+	})
+	q.Handle("fail", func(ctx context.Context, job *Job) error {
+		return errors.New("always fail")
+	})
+	q.Start()
+
+	if payload := <-done; payload != "a" {
+		t.Fatalf("payload: %s", payload)
+	}
+	waitFor(t, func() bool { return q.Pending() == 0 })
+
+	dead, err := q.DeadJobs()
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 2 || string(dead[0].Payload) != "b" {
+		t.Fatalf("dead jobs: %v, err: %v", dead, err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 0 {
+		t.Fatalf("pending after ack: %d", n)
+	}
+	if n, err := q.RequeueDead(); n != 1 || err != nil {
+		t.Fatalf("requeue dead: %d, err: %v", n, err)
+	}
+	if n := q.Pending(); n != 1 {
+		t.Fatalf("pending after requeue: %d", n)
+	}
+}
+
+func TestJobQueueCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &JobQueueConf{Dir: dir, NoSync: true, CompactThreshold: 10}
+	q, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Handle("ok", func(ctx context.Context, job *Job) error { return nil })
+	q.Start()
+
+	for i := 0; i < 30; i++ {
+		if _, err := q.Enqueue("ok", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return q.Pending() == 0 })
+
+	// 运行期间已compact，compact后写入的记录不丢
+	bs, err := ioutil.ReadFile(filepath.Join(dir, jobLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(bs, []byte("\n")); n > 20 {
+		t.Fatalf("queue log not compacted: %d records", n)
+	}
+
+	if _, err := q.Enqueue("hold", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 1 {
+		t.Fatalf("pending after reopen: %d", n)
+	}
+}
+
+func TestJobQueueTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &JobQueueConf{Dir: dir, NoSync: true}
+	torn := func() {
+		f, err := os.OpenFile(filepath.Join(dir, jobLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(`{"op":"enq","job":{"id":"x`))
+		f.Close()
+	}
+
+	// 没有其它进程使用时截掉
+	torn()
+	q, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 有其它进程使用时另起一行
+	torn()
+	q2, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q2.Enqueue("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	q2.Close()
+	q.Close()
+
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 2 {
+		t.Fatalf("pending: %d", n)
+	}
+}
+
+func TestJobQueueReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &JobQueueConf{Dir: dir, NoSync: true}
+	q, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟其它进程compact后替换队列文件
+	path := filepath.Join(dir, jobLogFile)
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs = append(bs, `{"op":"enq","job":{"id":"peer","name":"b"}}`+"\n"...)
+	if err := ioutil.WriteFile(path+".tmp", bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+
+	q.mu.Lock()
+	err = q.reopenIfReplaced()
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Pending(); n != 2 {
+		t.Fatalf("pending after reopen: %d", n)
+	}
+
+	// 之后的写入落在新文件里
+	if _, err := q.Enqueue("c", nil); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 3 {
+		t.Fatalf("pending: %d", n)
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &JobQueueConf{Dir: dir, NoSync: true}
+	q, err := OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	q.Handle("wait", func(ctx context.Context, job *Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	q.Start()
+	if _, err := q.Enqueue("wait", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 被cancel的任务留在队列里，不计入尝试次数
+	q, err = OpenJobQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 1 {
+		t.Fatalf("pending: %d", n)
+	}
+	for _, job := range q.pending {
+		if job.Attempts != 0 {
+			t.Fatalf("attempts: %d", job.Attempts)
+		}
+	}
+}
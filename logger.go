@@ -0,0 +1,132 @@
+// 此文件定义可替换的结构化日志接口，包内日志统一通过GetLogger输出
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel 日志级别
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(level))
+}
+
+// Logger 日志接口，kv为成对出现的key, value
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With 返回携带固定字段的Logger，比如trace id
+	With(kv ...interface{}) Logger
+}
+
+type stdLogger struct {
+	level  LogLevel
+	fields []interface{}
+}
+
+// NewStdLogger 返回基于标准库log的Logger，低于level的日志会被忽略
+func NewStdLogger(level LogLevel) Logger {
+	return &stdLogger{level: level}
+}
+
+func (l *stdLogger) Debug(msg string, kv ...interface{}) { l.output(LevelDebug, msg, kv) }
+func (l *stdLogger) Info(msg string, kv ...interface{})  { l.output(LevelInfo, msg, kv) }
+func (l *stdLogger) Warn(msg string, kv ...interface{})  { l.output(LevelWarn, msg, kv) }
+func (l *stdLogger) Error(msg string, kv ...interface{}) { l.output(LevelError, msg, kv) }
+
+func (l *stdLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &stdLogger{level: l.level, fields: fields}
+}
+
+func (l *stdLogger) output(level LogLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("[")
+	buf.WriteString(level.String())
+	buf.WriteString("] ")
+	buf.WriteString(msg)
+	writeKV(buf, l.fields)
+	writeKV(buf, kv)
+	log.Output(3, buf.String())
+}
+
+func writeKV(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(kv[i]))
+		buf.WriteByte('=')
+		if i+1 >= len(kv) {
+			buf.WriteString("<missing>")
+			break
+		}
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		buf.WriteString(v)
+	}
+}
+
+type loggerBox struct {
+	Logger
+}
+
+var (
+	defaultLogger = NewStdLogger(LevelInfo)
+	loggerValue   atomic.Value
+)
+
+// SetLogger 替换包内使用的Logger
+func SetLogger(l Logger) {
+	if l == nil {
+		l = defaultLogger
+	}
+	loggerValue.Store(loggerBox{l})
+}
+
+// GetLogger 返回当前使用的Logger
+func GetLogger() Logger {
+	if box, ok := loggerValue.Load().(loggerBox); ok {
+		return box.Logger
+	}
+	return defaultLogger
+}
+
+// LoggerWithTrace 返回携带trace id的Logger
+func LoggerWithTrace(trace *Trace) Logger {
+	if trace == nil || trace.ID == "" {
+		return GetLogger()
+	}
+	return GetLogger().With("trace_id", trace.ID)
+}
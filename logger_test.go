@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	flags := log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	l := NewStdLogger(LevelWarn)
+	l.Info("hidden")
+	l.Warn("shown", "k", "v w")
+	if got := buf.String(); got != "[WARN] shown k=\"v w\"\n" {
+		t.Errorf("level filter: %q", got)
+	}
+
+	buf.Reset()
+	l.With("a", 1).With("b", 2).Error("msg", "c")
+	if got := buf.String(); got != "[ERROR] msg a=1 b=2 c=<missing>\n" {
+		t.Errorf("with fields: %q", got)
+	}
+
+	// With不影响原Logger
+	buf.Reset()
+	l.Error("plain")
+	if got := buf.String(); got != "[ERROR] plain\n" {
+		t.Errorf("parent fields: %q", got)
+	}
+
+	SetLogger(l)
+	if GetLogger() != l {
+		t.Error("SetLogger not applied")
+	}
+	SetLogger(nil)
+	if GetLogger() != defaultLogger {
+		t.Error("SetLogger(nil) should fall back to default")
+	}
+
+	buf.Reset()
+	GetLogger().Debug("hidden")
+	GetLogger().Info("info")
+	if !strings.HasPrefix(buf.String(), "[INFO] info") || strings.Contains(buf.String(), "hidden") {
+		t.Errorf("default logger: %q", buf.String())
+	}
+}
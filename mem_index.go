@@ -0,0 +1,486 @@
+// 此文件定义通用的内存二级索引，实现了Index及BatchIndex，可直接通过RegisterIndex订阅更新
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMemIndexNotFound = errors.New("mem index not found")
+	ErrMemIndexNoPK     = errors.New("mem index primary key missing")
+	ErrMemIndexDataType = errors.New("mem index data type mismatch")
+)
+
+// KeyFunc 从数据中提取索引key，返回nil表示此数据不进入此索引
+type KeyFunc func(d interface{}) interface{}
+
+type secondaryIndex struct {
+	unique  bool
+	key     KeyFunc
+	entries map[interface{}]map[interface{}]bool // key -> pk集合
+	sorted  []interface{}                        // 有序的key，用于范围扫描
+}
+
+func (si *secondaryIndex) add(key, pk interface{}) {
+	pks, ok := si.entries[key]
+	if !ok {
+		pks = make(map[interface{}]bool)
+		si.entries[key] = pks
+
+		pos := sort.Search(len(si.sorted), func(i int) bool {
+			return compareKeys(si.sorted[i], key) >= 0
+		})
+		si.sorted = append(si.sorted, nil)
+		copy(si.sorted[pos+1:], si.sorted[pos:])
+		si.sorted[pos] = key
+	}
+	pks[pk] = true
+}
+
+func (si *secondaryIndex) remove(key, pk interface{}) {
+	pks, ok := si.entries[key]
+	if !ok {
+		return
+	}
+	delete(pks, pk)
+	if len(pks) > 0 {
+		return
+	}
+
+	delete(si.entries, key)
+	pos := sort.Search(len(si.sorted), func(i int) bool {
+		return compareKeys(si.sorted[i], key) >= 0
+	})
+	if pos < len(si.sorted) && compareKeys(si.sorted[pos], key) == 0 {
+		si.sorted = append(si.sorted[:pos], si.sorted[pos+1:]...)
+	}
+}
+
+// MemIndex 内存索引，按主键保存数据，并维护唯一及非唯一二级索引
+type MemIndex struct {
+	mu      sync.RWMutex
+	pk      KeyFunc
+	typ     reflect.Type // NewMemIndexFromTags时为sample的struct类型，只接收此类型的数据
+	data    map[interface{}]interface{}
+	keys    map[interface{}]map[string]interface{} // pk -> 索引名 -> 写入时提取的key，数据可能被调用方原地修改
+	indexes map[string]*secondaryIndex
+}
+
+// NewMemIndex pk用于提取主键
+func NewMemIndex(pk KeyFunc) *MemIndex {
+	return &MemIndex{
+		pk:      pk,
+		data:    make(map[interface{}]interface{}),
+		keys:    make(map[interface{}]map[string]interface{}),
+		indexes: make(map[string]*secondaryIndex),
+	}
+}
+
+// NewMemIndexFromTags 根据sample(struct或struct指针)的index tag创建索引：
+// `index:"pk"`为主键，`index:"unique"`为唯一索引，`index:"multi"`为非唯一索引，
+// 索引名默认为字段名，可通过`index:"unique,name=email"`指定，
+// 只接收与sample相同struct类型(或其指针)的数据，其它类型的更新返回ErrMemIndexDataType
+func NewMemIndexFromTags(sample interface{}) (mi *MemIndex, err error) {
+	typ := reflect.TypeOf(sample)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		err = fmt.Errorf("mem index sample must be struct, got %T", sample)
+		return
+	}
+
+	mi = NewMemIndex(nil)
+	mi.typ = typ
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("index")
+		if tag == "" || f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		kind := ""
+		for _, part := range strings.Split(tag, ",") {
+			if strings.HasPrefix(part, "name=") {
+				name = part[len("name="):]
+				continue
+			}
+			kind = part
+		}
+
+		// 不可比较的字段作为map key会panic
+		if !f.Type.Comparable() {
+			return nil, fmt.Errorf("mem index field %s: type %s not comparable", f.Name, f.Type)
+		}
+
+		key := fieldKeyFunc(typ, f.Index)
+		switch kind {
+		case "pk":
+			mi.pk = key
+		case "unique":
+			err = mi.AddIndex(name, true, key)
+		case "multi":
+			err = mi.AddIndex(name, false, key)
+		default:
+			err = fmt.Errorf("mem index field %s: unknown tag %q", f.Name, tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if mi.pk == nil {
+		err = ErrMemIndexNoPK
+		return nil, err
+	}
+	return
+}
+
+func fieldKeyFunc(typ reflect.Type, index []int) KeyFunc {
+	return func(d interface{}) interface{} {
+		val := val2val(reflect.ValueOf(d))
+		if !val.IsValid() || val.Type() != typ {
+			return nil
+		}
+		return val.FieldByIndex(index).Interface()
+	}
+}
+
+// AddIndex 添加二级索引，已有数据会被加入此索引
+func (mi *MemIndex) AddIndex(name string, unique bool, key KeyFunc) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	if _, ok := mi.indexes[name]; ok {
+		return fmt.Errorf("mem index %s already exists", name)
+	}
+
+	si := &secondaryIndex{
+		unique:  unique,
+		key:     key,
+		entries: make(map[interface{}]map[interface{}]bool),
+	}
+	keys := make(map[interface{}]interface{})
+	for pk, d := range mi.data {
+		k := key(d)
+		if k == nil {
+			continue
+		}
+		if !comparableKey(k) {
+			return fmt.Errorf("mem index %s: key type %T not comparable", name, k)
+		}
+		if unique && len(si.entries[k]) > 0 {
+			return fmt.Errorf("mem index %s: duplicate key %v", name, k)
+		}
+		si.add(k, pk)
+		keys[pk] = k
+	}
+	for pk, k := range keys {
+		mi.keys[pk][name] = k
+	}
+	mi.indexes[name] = si
+	return nil
+}
+
+// Register 通过RegisterIndex订阅DefaultTopic的更新，
+// NewMemIndexFromTags创建的索引只订阅sample类型(及其指针)的更新
+func (mi *MemIndex) Register(opts ...SubscribeOption) *Subscription {
+	if mi.typ != nil {
+		opts = append([]SubscribeOption{
+			WithDataType(reflect.Zero(mi.typ).Interface(), reflect.Zero(reflect.PtrTo(mi.typ)).Interface()),
+		}, opts...)
+	}
+	return RegisterIndex(mi, opts...)
+}
+
+// UpdateIndex ADD及UPDATE时写入，DELETE时删除，GET时忽略
+func (mi *MemIndex) UpdateIndex(d interface{}, t UpdateType, props map[string]interface{}) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	return mi.apply(d, t)
+}
+
+// UpdateIndexBatch 持有一次写锁处理全部更新，返回失败更新的聚合错误
+func (mi *MemIndex) UpdateIndexBatch(us []*Update) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	var errs MultiError
+	for _, u := range us {
+		if err := mi.apply(u.D, u.T); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (mi *MemIndex) apply(d interface{}, t UpdateType) error {
+	switch t {
+	case ADD, UPDATE:
+		return mi.upsert(d)
+	case DELETE:
+		return mi.remove(d)
+	}
+	return nil
+}
+
+func (mi *MemIndex) checkType(d interface{}) error {
+	if mi.typ == nil {
+		return nil
+	}
+	if val := val2val(reflect.ValueOf(d)); !val.IsValid() || val.Type() != mi.typ {
+		return ErrMemIndexDataType
+	}
+	return nil
+}
+
+func (mi *MemIndex) upsert(d interface{}) error {
+	if err := mi.checkType(d); err != nil {
+		return err
+	}
+	pk := mi.pk(d)
+	if pk == nil {
+		return ErrMemIndexNoPK
+	}
+	if !comparableKey(pk) {
+		return fmt.Errorf("mem index pk type %T not comparable", pk)
+	}
+
+	// 先检查key及唯一索引，避免部分写入
+	for name, si := range mi.indexes {
+		k := si.key(d)
+		if k == nil {
+			continue
+		}
+		if !comparableKey(k) {
+			return fmt.Errorf("mem index %s: key type %T not comparable, pk: %v", name, k, pk)
+		}
+		if !si.unique {
+			continue
+		}
+		for other := range si.entries[k] {
+			if other != pk {
+				return fmt.Errorf("mem index %s: duplicate key %v, pk: %v, conflict pk: %v", name, k, pk, other)
+			}
+		}
+	}
+
+	mi.unindex(pk)
+	keys := make(map[string]interface{}, len(mi.indexes))
+	for name, si := range mi.indexes {
+		if k := si.key(d); k != nil {
+			si.add(k, pk)
+			keys[name] = k
+		}
+	}
+	mi.data[pk] = d
+	mi.keys[pk] = keys
+	return nil
+}
+
+func (mi *MemIndex) remove(d interface{}) error {
+	if err := mi.checkType(d); err != nil {
+		return err
+	}
+	pk := mi.pk(d)
+	if pk == nil {
+		return ErrMemIndexNoPK
+	}
+	if !comparableKey(pk) {
+		return fmt.Errorf("mem index pk type %T not comparable", pk)
+	}
+
+	mi.unindex(pk)
+	delete(mi.data, pk)
+	delete(mi.keys, pk)
+	return nil
+}
+
+// comparableKey 检查k能否作为map key，不可比较的类型作为map key会panic
+func comparableKey(k interface{}) bool {
+	return reflect.TypeOf(k).Comparable()
+}
+
+// unindex 按写入时保存的key从二级索引中删除pk，而不是从已保存的数据中重新提取，
+// 调用方原地修改数据后再发布UPDATE时，已保存的数据里已是新的key
+func (mi *MemIndex) unindex(pk interface{}) {
+	for name, k := range mi.keys[pk] {
+		mi.indexes[name].remove(k, pk)
+	}
+}
+
+// Len 返回数据条数
+func (mi *MemIndex) Len() int {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	return len(mi.data)
+}
+
+// Get 按主键查询
+func (mi *MemIndex) Get(pk interface{}) (d interface{}, ok bool) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+	d, ok = mi.data[pk]
+	return
+}
+
+// Lookup 按二级索引查询，结果按主键排序
+func (mi *MemIndex) Lookup(name string, key interface{}) (ds []interface{}, err error) {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+
+	si, ok := mi.indexes[name]
+	if !ok {
+		err = ErrMemIndexNotFound
+		return
+	}
+	ds = mi.collect(si.entries[key])
+	return
+}
+
+// LookupOne 按唯一索引查询
+func (mi *MemIndex) LookupOne(name string, key interface{}) (d interface{}, ok bool, err error) {
+	ds, err := mi.Lookup(name, key)
+	if err != nil || len(ds) == 0 {
+		return
+	}
+	d, ok = ds[0], true
+	return
+}
+
+// Range 按二级索引key升序扫描[lo, hi)区间，lo或hi为nil表示不限制，fn返回false时停止
+func (mi *MemIndex) Range(name string, lo, hi interface{}, fn func(key, d interface{}) bool) error {
+	mi.mu.RLock()
+	defer mi.mu.RUnlock()
+
+	si, ok := mi.indexes[name]
+	if !ok {
+		return ErrMemIndexNotFound
+	}
+
+	pos := 0
+	if lo != nil {
+		pos = sort.Search(len(si.sorted), func(i int) bool {
+			return compareKeys(si.sorted[i], lo) >= 0
+		})
+	}
+	for ; pos < len(si.sorted); pos++ {
+		key := si.sorted[pos]
+		if hi != nil && compareKeys(key, hi) >= 0 {
+			break
+		}
+		for _, d := range mi.collect(si.entries[key]) {
+			if !fn(key, d) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (mi *MemIndex) collect(pks map[interface{}]bool) (ds []interface{}) {
+	sorted := make([]interface{}, 0, len(pks))
+	for pk := range pks {
+		sorted = append(sorted, pk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareKeys(sorted[i], sorted[j]) < 0
+	})
+
+	for _, pk := range sorted {
+		ds = append(ds, mi.data[pk])
+	}
+	return
+}
+
+// compareKeys 比较两个key，支持整数、浮点数、字符串、bool及time.Time，
+// 类型不同时按类型名比较，同为整数(或浮点数)的不同类型先按值比较，值相同时再按类型名比较，
+// 与map key一致，只有类型及值都相同时才返回0
+func compareKeys(a, b interface{}) int {
+	if c := compareValues(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+func compareValues(a, b interface{}) int {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+	}
+
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	ka, kb := keyKind(va), keyKind(vb)
+	if ka != kb {
+		return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+	}
+
+	switch ka {
+	case reflect.Int:
+		x, y := va.Int(), vb.Int()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case reflect.Uint:
+		x, y := va.Uint(), vb.Uint()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case reflect.Float64:
+		x, y := va.Float(), vb.Float()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case reflect.String:
+		return strings.Compare(va.String(), vb.String())
+	case reflect.Bool:
+		x, y := va.Bool(), vb.Bool()
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func keyKind(v reflect.Value) reflect.Kind {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return reflect.Uint
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	}
+	return v.Kind()
+}
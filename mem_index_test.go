@@ -0,0 +1,199 @@
+package utils
+
+import "testing"
+
+type memUser struct {
+	ID    int    `index:"pk"`
+	Email string `index:"unique,name=email"`
+	Age   int    `index:"multi"`
+}
+
+func TestMemIndex(t *testing.T) {
+	mi, err := NewMemIndexFromTags(&memUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewBus()
+	bus.Subscribe(DefaultTopic, mi)
+
+	for _, u := range []*memUser{
+		{ID: 1, Email: "a", Age: 20},
+		{ID: 2, Email: "b", Age: 30},
+		{ID: 3, Email: "c", Age: 20},
+		{ID: 4, Email: "d", Age: 40},
+	} {
+		if err := bus.Publish(DefaultTopic, u, ADD, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bus.Publish(DefaultTopic, &memUser{ID: 5, Email: "a"}, ADD, nil); err == nil {
+		t.Fatal("expected unique violation")
+	}
+	// 其它类型的数据不会覆盖主键相同的数据
+	type memOrder struct {
+		ID int
+	}
+	if err := mi.UpdateIndex(&memOrder{ID: 1}, ADD, nil); err != ErrMemIndexDataType {
+		t.Fatalf("other type: %v", err)
+	}
+	if err := mi.UpdateIndex(struct{ ID, Email, Age int }{ID: 1}, ADD, nil); err != ErrMemIndexDataType {
+		t.Fatalf("other struct shape: %v", err)
+	}
+	if d, ok := mi.Get(1); !ok || d.(*memUser).Email != "a" {
+		t.Fatalf("pk 1: %v", d)
+	}
+
+	// Register只订阅sample类型的更新
+	sub := mi.Register()
+	defer sub.Unsubscribe()
+	if err := Publish(DefaultTopic, &memOrder{ID: 1}, ADD, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish(DefaultTopic, memUser{ID: 6, Email: "f"}, ADD, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mi.Get(6); !ok {
+		t.Fatal("struct value not indexed")
+	}
+	mi.UpdateIndex(&memUser{ID: 6}, DELETE, nil)
+
+	bus.Publish(DefaultTopic, &memUser{ID: 2, Email: "b2", Age: 25}, UPDATE, nil)
+	bus.Publish(DefaultTopic, &memUser{ID: 4}, DELETE, nil)
+
+	if n := mi.Len(); n != 3 {
+		t.Fatalf("len: %d", n)
+	}
+	if d, ok, _ := mi.LookupOne("email", "b2"); !ok || d.(*memUser).ID != 2 {
+		t.Fatalf("lookup email: %v", d)
+	}
+	if _, ok, _ := mi.LookupOne("email", "b"); ok {
+		t.Fatal("stale unique key")
+	}
+	if ds, _ := mi.Lookup("Age", 20); len(ds) != 2 || ds[0].(*memUser).ID != 1 || ds[1].(*memUser).ID != 3 {
+		t.Fatalf("lookup age: %v", ds)
+	}
+
+	var ids []int
+	mi.Range("Age", 21, nil, func(key, d interface{}) bool {
+		ids = append(ids, d.(*memUser).ID)
+		return true
+	})
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("range: %v", ids)
+	}
+
+	ids = nil
+	mi.Range("Age", nil, 30, func(key, d interface{}) bool {
+		ids = append(ids, d.(*memUser).ID)
+		return len(ids) < 2
+	})
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Fatalf("range: %v", ids)
+	}
+}
+
+func TestMemIndexInPlaceUpdate(t *testing.T) {
+	mi, err := NewMemIndexFromTags(&memUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &memUser{ID: 1, Email: "a@x", Age: 20}
+	if err := mi.UpdateIndex(u, ADD, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 原地修改后发布UPDATE，老的key需要被删除
+	u.Email, u.Age = "b@x", 30
+	if err := mi.UpdateIndex(u, UPDATE, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := mi.LookupOne("email", "a@x"); ok {
+		t.Fatal("stale unique key")
+	}
+	if ds, _ := mi.Lookup("Age", 20); len(ds) != 0 {
+		t.Fatalf("stale multi key: %v", ds)
+	}
+	if d, ok, _ := mi.LookupOne("email", "b@x"); !ok || d.(*memUser).ID != 1 {
+		t.Fatalf("lookup email: %v", d)
+	}
+	if err := mi.UpdateIndex(&memUser{ID: 2, Email: "a@x"}, ADD, nil); err != nil {
+		t.Fatalf("reuse old key: %v", err)
+	}
+
+	// 原地修改后DELETE
+	u.Email = "c@x"
+	if err := mi.UpdateIndex(u, DELETE, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := mi.LookupOne("email", "b@x"); ok {
+		t.Fatal("stale key after delete")
+	}
+}
+
+func TestMemIndexKeyTypes(t *testing.T) {
+	mi := NewMemIndex(func(d interface{}) interface{} {
+		return d.([]interface{})[0]
+	})
+	if err := mi.AddIndex("k", false, func(d interface{}) interface{} {
+		return d.([]interface{})[1]
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// int(5)与int64(5)是不同的key
+	mi.UpdateIndex([]interface{}{2, 5}, ADD, nil)
+	mi.UpdateIndex([]interface{}{1, int64(5)}, ADD, nil)
+	mi.UpdateIndex([]interface{}{3, int32(4)}, ADD, nil)
+	mi.UpdateIndex([]interface{}{2, 5}, DELETE, nil)
+
+	if ds, _ := mi.Lookup("k", int64(5)); len(ds) != 1 {
+		t.Fatalf("lookup int64: %v", ds)
+	}
+	var keys []interface{}
+	mi.Range("k", nil, nil, func(key, d interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 2 || keys[0] != int32(4) || keys[1] != int64(5) {
+		t.Fatalf("range keys: %v", keys)
+	}
+}
+
+func TestMemIndexNotComparable(t *testing.T) {
+	type memTags struct {
+		ID   int      `index:"pk"`
+		Tags []string `index:"multi"`
+	}
+	if _, err := NewMemIndexFromTags(&memTags{}); err == nil {
+		t.Fatal("expected error for slice field")
+	}
+
+	mi := NewMemIndex(func(d interface{}) interface{} {
+		return d.([]interface{})[0]
+	})
+	mi.UpdateIndex([]interface{}{1, []int{1}}, ADD, nil)
+	if err := mi.AddIndex("k", false, func(d interface{}) interface{} {
+		return d.([]interface{})[1]
+	}); err == nil {
+		t.Fatal("expected error for slice key in existing data")
+	}
+
+	mi = NewMemIndex(func(d interface{}) interface{} {
+		return d.([]interface{})[0]
+	})
+	mi.AddIndex("k", false, func(d interface{}) interface{} {
+		return d.([]interface{})[1]
+	})
+	if err := mi.UpdateIndex([]interface{}{1, map[string]int{}}, ADD, nil); err == nil {
+		t.Fatal("expected error for map key")
+	}
+	if err := mi.UpdateIndex([]interface{}{[]int{1}, 1}, ADD, nil); err == nil {
+		t.Fatal("expected error for slice pk")
+	}
+	if mi.Len() != 0 {
+		t.Fatalf("len: %d", mi.Len())
+	}
+}
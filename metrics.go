@@ -0,0 +1,394 @@
+// 此文件定义不依赖第三方库的指标注册表，支持带label的counter、gauge及histogram，
+// 以Prometheus text格式输出
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets histogram默认的bucket，单位为秒
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultMetrics 内置指标所在的注册表
+var DefaultMetrics = NewMetricsRegistry()
+
+type metricFamily interface {
+	writeText(w *bufio.Writer)
+}
+
+// MetricsRegistry 指标注册表，实现了http.Handler，可直接挂载为/metrics
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]metricFamily
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		families: make(map[string]metricFamily),
+	}
+}
+
+// register 同名指标只注册一次，类型不同时panic
+func (reg *MetricsRegistry) register(name string, newFamily func() metricFamily) metricFamily {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	f, ok := reg.families[name]
+	if !ok {
+		f = newFamily()
+		reg.families[name] = f
+	}
+	return f
+}
+
+// Counter 返回名为name的counter，已存在时直接返回
+func (reg *MetricsRegistry) Counter(name, help string, labels ...string) *CounterVec {
+	f := reg.register(name, func() metricFamily {
+		return &CounterVec{newMetricVec(name, help, "counter", labels)}
+	})
+	cv, ok := f.(*CounterVec)
+	if !ok {
+		panic(fmt.Sprintf("metrics %s already registered as %T", name, f))
+	}
+	return cv
+}
+
+// Gauge 返回名为name的gauge，已存在时直接返回
+func (reg *MetricsRegistry) Gauge(name, help string, labels ...string) *GaugeVec {
+	f := reg.register(name, func() metricFamily {
+		return &GaugeVec{newMetricVec(name, help, "gauge", labels)}
+	})
+	gv, ok := f.(*GaugeVec)
+	if !ok {
+		panic(fmt.Sprintf("metrics %s already registered as %T", name, f))
+	}
+	return gv
+}
+
+// Histogram 返回名为name的histogram，buckets为nil时使用DefaultBuckets，已存在时直接返回
+func (reg *MetricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	f := reg.register(name, func() metricFamily {
+		sorted := append([]float64(nil), buckets...)
+		sort.Float64s(sorted)
+		return &HistogramVec{metricVec: newMetricVec(name, help, "histogram", labels), buckets: sorted}
+	})
+	hv, ok := f.(*HistogramVec)
+	if !ok {
+		panic(fmt.Sprintf("metrics %s already registered as %T", name, f))
+	}
+	return hv
+}
+
+// GaugeFunc 注册输出时才计算的gauge
+func (reg *MetricsRegistry) GaugeFunc(name, help string, fn func() float64) {
+	reg.register(name, func() metricFamily {
+		return &gaugeFunc{name: name, help: help, fn: fn}
+	})
+}
+
+// WriteText 按名字顺序以Prometheus text格式输出所有指标
+func (reg *MetricsRegistry) WriteText(w io.Writer) error {
+	reg.mu.Lock()
+	names := make([]string, 0, len(reg.families))
+	for name := range reg.families {
+		names = append(names, name)
+	}
+	families := make([]metricFamily, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		families = append(families, reg.families[name])
+	}
+	reg.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+func (reg *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	reg.WriteText(w)
+}
+
+// metricVec 按label值区分的一组指标
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu       sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newMetricVec(name, help, typ string, labels []string) *metricVec {
+	return &metricVec{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+	}
+}
+
+func (v *metricVec) with(values []string, newChild func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics %s: expect %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok = v.children[key]; !ok {
+		child = newChild()
+		v.children[key] = child
+		v.values[key] = append([]string(nil), values...)
+	}
+	return child
+}
+
+// each 按label值顺序遍历
+func (v *metricVec) each(fn func(values []string, child interface{})) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		child, values := v.children[key], v.values[key]
+		v.mu.RUnlock()
+		fn(values, child)
+	}
+}
+
+func (v *metricVec) writeHeader(w *bufio.Writer) {
+	if v.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeMetricHelp(v.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// labelPairs 返回{a="x",b="y"}形式的label，extra为追加的label，比如histogram的le
+func (v *metricVec) labelPairs(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i, label := range v.labels {
+		pairs = append(pairs, label+`="`+escapeMetricLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeMetricLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeMetricHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatMetricValue(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// atomicFloat 以uint64位存储的float64
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+type Counter struct {
+	v atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add delta必须>=0
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.v.add(delta)
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+type CounterVec struct {
+	*metricVec
+}
+
+// With 返回对应label值的counter，label值个数必须与注册时一致
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (cv *CounterVec) writeText(w *bufio.Writer) {
+	cv.writeHeader(w)
+	cv.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, cv.labelPairs(values), formatMetricValue(child.(*Counter).Value()))
+	})
+}
+
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.set(v)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+type GaugeVec struct {
+	*metricVec
+}
+
+// With 返回对应label值的gauge，label值个数必须与注册时一致
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.with(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (gv *GaugeVec) writeText(w *bufio.Writer) {
+	gv.writeHeader(w)
+	gv.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", gv.name, gv.labelPairs(values), formatMetricValue(child.(*Gauge).Value()))
+	})
+}
+
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (g *gaugeFunc) writeText(w *bufio.Writer) {
+	if g.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", g.name, escapeMetricHelp(g.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.fn()))
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64 // 非累计，输出时累加
+	count   uint64
+	sum     atomicFloat
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	h.sum.add(v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+type HistogramVec struct {
+	*metricVec
+	buckets []float64
+}
+
+// With 返回对应label值的histogram，label值个数必须与注册时一致
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values, func() interface{} {
+		return &Histogram{
+			buckets: hv.buckets,
+			counts:  make([]uint64, len(hv.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (hv *HistogramVec) writeText(w *bufio.Writer) {
+	hv.writeHeader(w)
+	hv.each(func(values []string, child interface{}) {
+		h := child.(*Histogram)
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelPairs(values, "le", formatMetricValue(le)), cumulative)
+		}
+		count := atomic.LoadUint64(&h.count)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelPairs(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, hv.labelPairs(values), formatMetricValue(h.sum.get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, hv.labelPairs(values), count)
+	})
+}
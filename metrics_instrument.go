@@ -0,0 +1,118 @@
+// 此文件定义内置指标：入口请求、GPP出口请求、Updates投递及异步任务，都注册在DefaultMetrics
+
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpServerRequests = DefaultMetrics.Counter("http_server_requests_total",
+		"Inbound http requests.", "route", "code")
+	httpServerDuration = DefaultMetrics.Histogram("http_server_request_duration_seconds",
+		"Inbound http request latency.", nil, "route")
+	httpServerRets = DefaultMetrics.Counter("http_server_resp_ret_total",
+		"Resp.Ret of inbound requests replied by Base.", "route", "ret")
+
+	httpClientRequests = DefaultMetrics.Counter("http_client_requests_total",
+		"Outbound GPP requests, status is error when no response.", "host", "status")
+	httpClientDuration = DefaultMetrics.Histogram("http_client_request_duration_seconds",
+		"Outbound GPP request latency including reading body.", nil, "host")
+
+	updatesDeliveries = DefaultMetrics.Counter("updates_delivery_attempts_total",
+		"Updates delivery attempts, including retries.", "topic", "result")
+	updatesDuration = DefaultMetrics.Histogram("updates_delivery_duration_seconds",
+		"Updates delivery latency of each attempt.", nil, "topic")
+	updatesFailures = DefaultMetrics.Counter("updates_delivery_failures_total",
+		"Updates finally failed and sent to dead letter.", "topic")
+
+	asyncTaskRuns = DefaultMetrics.Counter("async_task_runs_total",
+		"Finished named async tasks.", "name", "result")
+	asyncTaskDuration = DefaultMetrics.Histogram("async_task_duration_seconds",
+		"Named async task run time.", nil, "name")
+)
+
+func init() {
+	DefaultMetrics.GaugeFunc("async_tasks", "Unfinished async tasks.", func() float64 {
+		return float64(AsyncTaskNum())
+	})
+}
+
+// InstrumentHandler 记录h的请求数(按route及http状态码)及耗时
+func InstrumentHandler(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bt := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				observeRequest(route, http.StatusInternalServerError, bt)
+				panic(err)
+			}
+			observeRequest(route, sw.status, bt)
+		}()
+		h.ServeHTTP(sw.wrap(), r)
+	})
+}
+
+// InstrumentBase 同InstrumentHandler，并依据Base捕获的返回记录Resp.Ret分布，
+// 可与AccessLog组合：AccessLog(conf, newCtrl, InstrumentBase(route, h))
+func InstrumentBase(route string, h func(IBase, http.ResponseWriter, *http.Request)) func(IBase, http.ResponseWriter, *http.Request) {
+	return func(c IBase, w http.ResponseWriter, r *http.Request) {
+		bt := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				ObserveRequest(c, route, http.StatusInternalServerError, bt)
+				panic(err)
+			}
+			ObserveRequest(c, route, sw.status, bt)
+		}()
+		h(c, sw.wrap(), r)
+	}
+}
+
+// ObserveRequest 记录一次请求，可用于已有框架的后置filter里
+func ObserveRequest(c IBase, route string, status int, bt time.Time) {
+	observeRequest(route, status, bt)
+
+	if ret, _, ok := respRet(c); ok {
+		httpServerRets.With(route, strconv.Itoa(int(ret))).Inc()
+	}
+}
+
+func observeRequest(route string, status int, bt time.Time) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpServerRequests.With(route, strconv.Itoa(status)).Inc()
+	httpServerDuration.With(route).Observe(time.Since(bt).Seconds())
+}
+
+func observeHTTPClient(host string, resp *http.Response, bt time.Time) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	httpClientRequests.With(host, status).Inc()
+	httpClientDuration.With(host).Observe(time.Since(bt).Seconds())
+}
+
+func observeUpdateDelivery(topic Topic, err error, bt time.Time) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	updatesDeliveries.With(string(topic), result).Inc()
+	updatesDuration.With(string(topic)).Observe(time.Since(bt).Seconds())
+}
+
+func observeAsyncTask(name string, err error, bt time.Time) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	asyncTaskRuns.With(name, result).Inc()
+	asyncTaskDuration.With(name).Observe(time.Since(bt).Seconds())
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	reg := NewMetricsRegistry()
+	reg.Counter("req_total", "Requests.", "code").With("200").Add(2)
+	reg.Counter("req_total", "Requests.", "code").With("500").Inc()
+	reg.Gauge("temp", "", "room").With(`a"b`).Set(1.5)
+	h := reg.Histogram("latency_seconds", "", []float64{0.1, 1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.5)
+	h.With().Observe(5)
+	reg.GaugeFunc("up", "", func() float64 { return 1 })
+
+	buf := &bytes.Buffer{}
+	if err := reg.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP req_total Requests.
+# TYPE req_total counter
+req_total{code="200"} 2
+req_total{code="500"} 1
+# TYPE temp gauge
+temp{room="a\"b"} 1.5
+# TYPE up gauge
+up 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	h := InstrumentHandler("/test/instrument", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	// 计数器是全局的，比较前后的差值，-count>1时也能通过
+	before := httpServerRequests.With("/test/instrument", "418").Value()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if v := httpServerRequests.With("/test/instrument", "418").Value() - before; v != 1 {
+		t.Errorf("requests: %v", v)
+	}
+
+	c := &Base{}
+	InstrumentBase("/test/base", func(c IBase, w http.ResponseWriter, r *http.Request) {
+		c.ReplyFail(w, CodeSrv)
+	})(c, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	buf := &bytes.Buffer{}
+	DefaultMetrics.WriteText(buf)
+	if !strings.Contains(buf.String(), `http_server_resp_ret_total{route="/test/base",ret="`) {
+		t.Errorf("resp ret not recorded:\n%s", buf)
+	}
+}
+
+func TestInstrumentHandlerPanic(t *testing.T) {
+	h := InstrumentHandler("/test/panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	before := httpServerRequests.With("/test/panic", "500").Value()
+	func() {
+		defer func() {
+			if err := recover(); err != "oops" {
+				t.Errorf("panic not propagated: %v", err)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	if v := httpServerRequests.With("/test/panic", "500").Value() - before; v != 1 {
+		t.Errorf("requests: %v", v)
+	}
+	if v := httpServerRequests.With("/test/panic", "200").Value(); v != 0 {
+		t.Errorf("panic recorded as 200: %v", v)
+	}
+}
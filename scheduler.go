@@ -0,0 +1,331 @@
+// 此文件定义定时任务调度，支持固定间隔及cron表达式，任务作为异步任务运行，
+// AsyncTaskShutdown(Server退出时会调用)时自动停止
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule 用于计算下次执行时间
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (every everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(every))
+}
+
+// Every 返回固定间隔的Schedule
+func Every(d time.Duration) Schedule {
+	if d <= 0 {
+		d = time.Second
+	}
+	return everySchedule(d)
+}
+
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron 解析标准5段cron表达式(分 时 日 月 周)，支持* , - /，
+// 以及@hourly, @daily等描述符和"@every 5m"
+func ParseCron(expr string) (sched Schedule, err error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every "):]))
+		if err != nil {
+			return nil, err
+		}
+		return Every(d), nil
+	}
+	if v, ok := cronDescriptors[expr]; ok {
+		expr = v
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		err = fmt.Errorf("cron expr %q: expected 5 fields, got %d", expr, len(fields))
+		return
+	}
+
+	cs := &cronSchedule{}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	masks := []*uint64{&cs.minute, &cs.hour, &cs.dom, &cs.month, &cs.dow}
+	for i, field := range fields {
+		if *masks[i], err = parseCronField(field, bounds[i][0], bounds[i][1]); err != nil {
+			err = fmt.Errorf("cron expr %q: %v", expr, err)
+			return
+		}
+	}
+	// 周日既可以用0也可以用7表示
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	cs.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+
+	sched = cs
+	return
+}
+
+func parseCronField(field string, min, max int) (mask uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if pos := strings.Index(part, "/"); pos >= 0 {
+			if step, err = strconv.Atoi(part[pos+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			part = part[:pos]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			pos := strings.Index(part, "-")
+			if lo, err = strconv.Atoi(part[:pos]); err != nil {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+			if hi, err = strconv.Atoi(part[pos+1:]); err != nil {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			if lo, err = strconv.Atoi(part); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %q out of range [%d, %d]", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+func (cs *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatch(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (cs *cronSchedule) dayMatch(t time.Time) bool {
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// SchedOption 定时任务选项
+type SchedOption func(*schedJob)
+
+// WithJitter 每次执行前随机延迟[0, d)，避免多实例同时执行
+func WithJitter(d time.Duration) SchedOption {
+	return func(job *schedJob) {
+		job.jitter = d
+	}
+}
+
+// WithSkipIfRunning 上一次执行尚未结束时跳过本次
+func WithSkipIfRunning() SchedOption {
+	return func(job *schedJob) {
+		job.skipIfRunning = true
+	}
+}
+
+type schedJob struct {
+	name          string
+	sched         Schedule
+	f             func(ctx context.Context) error
+	jitter        time.Duration
+	skipIfRunning bool
+
+	mu      sync.Mutex
+	running int
+}
+
+// Scheduler 定时任务调度器
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []*schedJob
+	names   map[string]bool
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	ctx, cancel := context.WithCancel(asyncTaskCtx)
+	return &Scheduler{
+		names:  make(map[string]bool),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add 添加名为name的定时任务，Start之后添加的任务立即开始调度
+func (s *Scheduler) Add(name string, sched Schedule, f func(ctx context.Context) error, opts ...SchedOption) (err error) {
+	job := &schedJob{
+		name:  name,
+		sched: sched,
+		f:     f,
+	}
+	for _, opt := range opts {
+		opt(job)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.names[name] {
+		err = fmt.Errorf("sched job %s already exists", name)
+		return
+	}
+	s.names[name] = true
+	s.jobs = append(s.jobs, job)
+
+	if s.started {
+		s.loop(job)
+	}
+	return
+}
+
+// Every 添加固定间隔执行的定时任务
+func (s *Scheduler) Every(name string, d time.Duration, f func(ctx context.Context) error, opts ...SchedOption) error {
+	return s.Add(name, Every(d), f, opts...)
+}
+
+// Cron 添加按cron表达式执行的定时任务
+func (s *Scheduler) Cron(name string, expr string, f func(ctx context.Context) error, opts ...SchedOption) (err error) {
+	sched, err := ParseCron(expr)
+	if err != nil {
+		return
+	}
+	return s.Add(name, sched, f, opts...)
+}
+
+// Start 开始调度，AsyncTaskShutdown时自动Stop，
+// Server设置了SkipAsyncTaskShutdown时可通过BeforeShutdown(s.Stop)在退出时停止
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return
+	}
+	s.started = true
+
+	for _, job := range s.jobs {
+		s.loop(job)
+	}
+}
+
+// Stop 停止调度，并cancel执行中任务的ctx，不等待执行中的任务结束
+func (s *Scheduler) Stop() {
+	s.cancel()
+}
+
+// Wait 等待调度循环及执行中的任务结束
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// goTask 以异步任务方式运行，出错只记录日志
+func (s *Scheduler) goTask(name string, f func() error) {
+	s.wg.Add(1)
+	goAsyncTask(name, func(context.Context) error {
+		return f()
+	}, func(error) {
+		s.wg.Done()
+	})
+}
+
+func (s *Scheduler) loop(job *schedJob) {
+	s.goTask("sched:"+job.name, func() error {
+		for {
+			now := time.Now()
+			next := job.sched.Next(now)
+			if next.IsZero() {
+				return nil
+			}
+			if job.jitter > 0 {
+				next = next.Add(time.Duration(rand.Int63n(int64(job.jitter))))
+			}
+
+			timer := time.NewTimer(next.Sub(now))
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return nil
+			case <-timer.C:
+			}
+
+			job.mu.Lock()
+			if job.skipIfRunning && job.running > 0 {
+				job.mu.Unlock()
+				GetLogger().Debug("utils.Scheduler skip running job", "name", job.name)
+				continue
+			}
+			job.running++
+			job.mu.Unlock()
+
+			s.goTask("sched:"+job.name+":run", func() error {
+				defer func() {
+					job.mu.Lock()
+					job.running--
+					job.mu.Unlock()
+				}()
+				return job.f(s.ctx)
+			})
+		}
+	})
+}
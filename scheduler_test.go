@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2024, 1, 31, 23, 58, 30, 0, time.UTC)
+	for expr, want := range map[string]time.Time{
+		"* * * * *":      time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+		"*/15 * * * *":   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"30 2 * * *":     time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC),
+		"0 0 29 2 *":     time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 9 * * 1-5":    time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC),
+		"0 0 * * 7":      time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC),
+		"0 0 15 * 1":     time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC),
+		"@monthly":       time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"@every 90s":     base.Add(time.Second * 90),
+		"5,10 0-1/1 * *": {},
+	} {
+		sched, err := ParseCron(expr)
+		if want.IsZero() {
+			if err == nil {
+				t.Errorf("%s: expected err", expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if got := sched.Next(base); !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	s := NewScheduler()
+	var runs, skipRuns int32
+	if err := s.Every("tick", time.Millisecond*10, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Every("tick", time.Second, func(ctx context.Context) error { return nil }); err == nil {
+		t.Error("duplicate name accepted")
+	}
+
+	// 执行中的任务未结束时跳过之后的调度
+	release := make(chan bool)
+	if err := s.Every("slow", time.Millisecond*5, func(ctx context.Context) error {
+		atomic.AddInt32(&skipRuns, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	}, WithSkipIfRunning()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) >= 3 })
+
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadInt32(&skipRuns); n != 1 {
+		t.Errorf("skip if running: %d runs", n)
+	}
+	close(release)
+	waitFor(t, func() bool { return atomic.LoadInt32(&skipRuns) >= 2 })
+
+	s.Stop()
+	s.Wait()
+	n := atomic.LoadInt32(&runs)
+	time.Sleep(time.Millisecond * 30)
+	if m := atomic.LoadInt32(&runs); m != n {
+		t.Errorf("runs after stop: %d -> %d", n, m)
+	}
+}
+
+// AsyncTaskShutdown只能执行一次，在子进程里测试以免影响其它用例
+func TestSchedulerStopOnShutdown(t *testing.T) {
+	if os.Getenv("UTILS_TEST_SCHED_SHUTDOWN") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSchedulerStopOnShutdown$", "-test.v")
+		cmd.Env = append(os.Environ(), "UTILS_TEST_SCHED_SHUTDOWN=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "--- PASS") {
+			t.Fatalf("err: %v, output:\n%s", err, out)
+		}
+		return
+	}
+
+	s := NewScheduler()
+	started := make(chan bool, 1)
+	s.Every("block", time.Millisecond*5, func(ctx context.Context) error {
+		select {
+		case started <- true:
+		default:
+		}
+		<-ctx.Done()
+		return nil
+	}, WithSkipIfRunning())
+	s.Start()
+	<-started
+
+	done, remain, abandoned := AsyncTaskShutdown(time.Second * 5)
+	if !done || remain != 0 || abandoned != nil {
+		t.Fatalf("done: %v, remain: %d, abandoned: %v", done, remain, abandoned)
+	}
+	s.Wait()
+}
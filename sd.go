@@ -0,0 +1,151 @@
+// 此文件定义systemd的socket activation及sd_notify支持，不依赖libsystemd
+
+package utils
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sd_notify的常用状态
+const (
+	SdReady     = "READY=1"
+	SdReloading = "RELOADING=1"
+	SdStopping  = "STOPPING=1"
+	SdWatchdog  = "WATCHDOG=1"
+)
+
+// sdListenFdsStart systemd传递的第一个fd
+const sdListenFdsStart = 3
+
+// SdNotify 向NOTIFY_SOCKET发送状态，多个状态用\n分隔，
+// 未设置NOTIFY_SOCKET(不是由systemd启动)时返回sent为false
+func SdNotify(state string) (sent bool, err error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+
+	// @开头为abstract socket
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return
+	}
+	sent = true
+	return
+}
+
+// SdWatchdogInterval 返回systemd要求的watchdog间隔(WATCHDOG_USEC)，未启用时ok为false，
+// 一般每隔interval/2发送一次SdWatchdog
+func SdWatchdogInterval() (interval time.Duration, ok bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval, ok = time.Duration(usec)*time.Microsecond, true
+	return
+}
+
+// SdListenFds 返回systemd socket activation传递的fd，按顺序对应LISTEN_FDNAMES里的名字，
+// 未命名的名字为空，LISTEN_PID不是本进程时返回nil
+func SdListenFds() (names []string, fds []uintptr) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+
+	fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(fdNames) && fdNames[i] != "unknown" {
+			name = fdNames[i]
+		}
+		names = append(names, name)
+		fds = append(fds, uintptr(sdListenFdsStart+i))
+	}
+	return
+}
+
+// sdListeners 将systemd传递的fd对应到监听：名字相同的优先，未命名的fd按顺序分配给剩下的监听
+func (srv *Server) sdListeners() map[string]uintptr {
+	names, fds := SdListenFds()
+	if len(fds) == 0 {
+		return nil
+	}
+
+	result := make(map[string]uintptr)
+	known := make(map[string]bool)
+	for _, sl := range srv.listeners {
+		known[sl.conf.Name] = true
+	}
+
+	var unnamed []uintptr
+	for i, fd := range fds {
+		if known[names[i]] {
+			result[names[i]] = fd
+			continue
+		}
+		unnamed = append(unnamed, fd)
+	}
+
+	for _, sl := range srv.listeners {
+		if len(unnamed) == 0 {
+			break
+		}
+		if _, ok := result[sl.conf.Name]; ok {
+			continue
+		}
+		result[sl.conf.Name] = unnamed[0]
+		unnamed = unnamed[1:]
+	}
+	return result
+}
+
+// sdNotify 发送状态，出错时只记录日志
+func sdNotify(state string) {
+	if _, err := SdNotify(state); err != nil {
+		GetLogger().Warn("utils.SdNotify failed", "state", state, "err", err)
+	}
+}
+
+// sdWatchdog 启用了systemd watchdog时定时发送SdWatchdog，直到stop关闭
+func sdWatchdog(stop chan struct{}) {
+	interval, ok := SdWatchdogInterval()
+	if !ok {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sdNotify(SdWatchdog)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	for _, state := range []string{SdReady, SdReloading, SdWatchdog, SdStopping} {
+		sent, err := SdNotify(state)
+		if !sent || err != nil {
+			t.Fatalf("notify %s, sent: %v, err: %v", state, sent, err)
+		}
+
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != state {
+			t.Errorf("got %q, want %q", got, state)
+		}
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := SdNotify(SdReady); sent || err != nil {
+		t.Errorf("without NOTIFY_SOCKET, sent: %v, err: %v", sent, err)
+	}
+}
+
+func TestSdListenFds(t *testing.T) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+	if _, fds := SdListenFds(); fds != nil {
+		t.Errorf("other pid, fds: %v", fds)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDNAMES", "admin:unknown")
+
+	srv := NewServer(":0", nil, time.Second, 0, time.Second)
+	srv.AddListener(&ListenerConf{Name: "admin", Addr: ":0"})
+	fds := srv.sdListeners()
+	if fds["admin"] != 3 || fds[DefaultListenerName] != 4 {
+		t.Errorf("fds: %v", fds)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	if interval, ok := SdWatchdogInterval(); !ok || interval != 2*time.Second {
+		t.Errorf("interval: %v, ok: %v", interval, ok)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "")
+	if _, ok := SdWatchdogInterval(); ok {
+		t.Error("watchdog should be disabled")
+	}
+}
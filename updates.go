@@ -4,7 +4,10 @@ package utils
 
 import (
 	"fmt"
+	"reflect"
 	"runtime/debug"
+	"sync"
+	"time"
 )
 
 // UpdateType 表示类型
@@ -21,28 +24,546 @@ const (
 	GET
 )
 
-var (
-	indices = make([]Index, 0)
-)
+// Topic 订阅主题，Updates及RegisterIndex使用DefaultTopic
+type Topic string
+
+const DefaultTopic Topic = ""
 
+// Index 订阅者，返回error时按订阅的retry配置重试，仍失败时交给dead letter
 type Index interface {
-	UpdateIndex(d interface{}, t UpdateType, props map[string]interface{})
+	UpdateIndex(d interface{}, t UpdateType, props map[string]interface{}) error
 }
 
-func Updates(d interface{}, t UpdateType, props map[string]interface{}) {
-	AsyncTaskEnter()
+// IndexFunc 将普通函数适配为Index
+type IndexFunc func(d interface{}, t UpdateType, props map[string]interface{}) error
+
+func (f IndexFunc) UpdateIndex(d interface{}, t UpdateType, props map[string]interface{}) error {
+	return f(d, t, props)
+}
+
+// UpdateError 单个订阅者投递失败
+type UpdateError struct {
+	Index  Index
+	Update *Update
+	Err    error
+}
+
+func (e *UpdateError) Error() string {
+	return fmt.Sprintf("update index %T, topic: %q, type: %d: %v", e.Index, e.Update.Topic, e.Update.T, e.Err)
+}
+
+// DeadLetterFunc 投递重试后仍失败时调用
+type DeadLetterFunc func(u *Update, index Index, err error)
+
+// Update 一次发布的内容
+type Update struct {
+	Topic Topic
+	D     interface{}
+	T     UpdateType
+	Props map[string]interface{}
+	Seq   uint64 // 设置了EventLog时为事件日志里的序号，投递前写入
+}
+
+// SubscribeOption 订阅选项
+type SubscribeOption func(*Subscription)
+
+// WithAsync 异步投递，每个订阅者有独立的有界队列，队列满时阻塞发布者，
+// 默认单队列，按发布顺序投递
+func WithAsync(queueSize int) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.async = true
+		sub.queueSize = queueSize
+		if sub.shards == 0 {
+			sub.shards = 1
+		}
+	}
+}
+
+// WithOrderKey 分为shards个队列并发异步投递，key相同的更新保证按发布顺序投递，
+// 隐含WithAsync，未设置WithAsync时每个队列长度为0
+func WithOrderKey(shards int, key func(*Update) string) SubscribeOption {
+	return func(sub *Subscription) {
+		if shards <= 0 {
+			shards = 1
+		}
+		sub.async = true
+		sub.shards = shards
+		sub.key = key
+	}
+}
+
+// WithRetry 投递失败时最多重试attempts次，每次间隔backoff，同步订阅会阻塞发布者
+func WithRetry(attempts int, backoff time.Duration) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.retry = attempts
+		sub.backoff = backoff
+	}
+}
+
+// WithDeadLetter 投递重试后仍失败时调用f，未设置时使用Bus的dead letter
+func WithDeadLetter(f DeadLetterFunc) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.deadLetter = f
+	}
+}
+
+// WithUpdateTypes 只接收指定UpdateType的更新
+func WithUpdateTypes(ts ...UpdateType) SubscribeOption {
+	return func(sub *Subscription) {
+		if sub.types == nil {
+			sub.types = make(map[UpdateType]bool)
+		}
+		for _, t := range ts {
+			sub.types[t] = true
+		}
+	}
+}
+
+// WithDataType 只接收d的类型与samples之一相同的更新，比如WithDataType((*User)(nil))
+func WithDataType(samples ...interface{}) SubscribeOption {
+	return func(sub *Subscription) {
+		if sub.dataTypes == nil {
+			sub.dataTypes = make(map[reflect.Type]bool)
+		}
+		for _, sample := range samples {
+			sub.dataTypes[reflect.TypeOf(sample)] = true
+		}
+	}
+}
+
+// WithFilter 只接收filter返回true的更新，多次设置时需全部满足
+func WithFilter(filter func(props map[string]interface{}) bool) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.filters = append(sub.filters, filter)
+	}
+}
+
+// Subscription 一个订阅者
+type Subscription struct {
+	bus   *Bus
+	topic Topic
+	index Index
+
+	async     bool
+	queueSize int
+	shards    int
+	key       func(*Update) string
+
+	retry      int
+	backoff    time.Duration
+	deadLetter DeadLetterFunc
+
+	types     map[UpdateType]bool
+	dataTypes map[reflect.Type]bool
+	filters   []func(props map[string]interface{}) bool
+
+	coalesceWindow time.Duration
+	coalesceKey    func(*Update) string
+	coalescer      *coalescer
+
+	mu      sync.RWMutex
+	closed  bool
+	queues  []chan []*Update
+	sending sync.WaitGroup // 正在入队的发布者，全部返回后才能关闭队列
+	wg      sync.WaitGroup
+}
+
+// Unsubscribe 取消订阅，合并窗口内及异步订阅已入队的更新会继续投递完
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.remove(sub)
+
+	if sub.coalescer != nil {
+		sub.coalescer.flush()
+	}
+
+	sub.mu.Lock()
+	closed := sub.closed
+	sub.closed = true
+	sub.mu.Unlock()
+
+	if !closed {
+		sub.sending.Wait()
+		for _, q := range sub.queues {
+			close(q)
+		}
+	}
+
+	sub.wg.Wait()
+}
+
+// match 判断此订阅者是否需要此更新
+func (sub *Subscription) match(u *Update) bool {
+	if sub.types != nil && !sub.types[u.T] {
+		return false
+	}
+	if sub.dataTypes != nil && !sub.dataTypes[reflect.TypeOf(u.D)] {
+		return false
+	}
+	for _, filter := range sub.filters {
+		if !filter(u.Props) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sub *Subscription) start() {
+	if sub.coalesceWindow > 0 {
+		sub.coalescer = newCoalescer(sub)
+	}
+
+	if !sub.async {
+		return
+	}
+
+	sub.queues = make([]chan []*Update, sub.shards)
+	for i := range sub.queues {
+		q := make(chan []*Update, sub.queueSize)
+		sub.queues[i] = q
+		sub.wg.Add(1)
+		go func() {
+			defer sub.wg.Done()
+			for us := range q {
+				sub.deliverAsync(us)
+			}
+		}()
+	}
+}
+
+// submit 按订阅方式投递已经过滤的更新，返回同步投递的错误
+func (sub *Subscription) submit(us []*Update) MultiError {
+	if sub.coalescer != nil {
+		sub.coalescer.add(us)
+		return nil
+	}
+	if sub.async {
+		sub.enqueue(us)
+		return nil
+	}
+	return sub.deliverBatch(us)
+}
+
+// enqueue 入队时不持有sub.mu，队列满时只阻塞发布者本身
+func (sub *Subscription) enqueue(us []*Update) {
+	sub.mu.RLock()
+	if sub.closed {
+		sub.mu.RUnlock()
+		return
+	}
+	sub.sending.Add(1)
+	sub.mu.RUnlock()
+	defer sub.sending.Done()
+
+	if sub.key == nil || len(sub.queues) == 1 {
+		sub.bus.enter()
+		sub.queues[0] <- us
+		return
+	}
+
+	// 按key分到不同队列，相同key在同一队列里保持顺序
+	shards := make([][]*Update, len(sub.queues))
+	for _, u := range us {
+		pos := Hash33(sub.key(u)) % len(sub.queues)
+		shards[pos] = append(shards[pos], u)
+	}
+	for pos, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		sub.bus.enter()
+		sub.queues[pos] <- shard
+	}
+}
+
+func (sub *Subscription) deliverAsync(us []*Update) {
+	defer sub.bus.exit()
+	sub.deliverBatch(us)
+}
 
+// deliverBatch 订阅者实现了BatchIndex时一次投递，否则逐个投递
+func (sub *Subscription) deliverBatch(us []*Update) (errs MultiError) {
+	bi, ok := sub.index.(BatchIndex)
+	if !ok || len(us) == 1 {
+		for _, u := range us {
+			if err := sub.deliver(u); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return
+	}
+
+	err := sub.withRetry(func() error {
+		return sub.call(us[0].Topic, func() error {
+			return bi.UpdateIndexBatch(us)
+		})
+	})
+	if err == nil {
+		return
+	}
+
+	for _, u := range us {
+		errs = append(errs, sub.fail(u, err))
+	}
+	return
+}
+
+// deliver 投递给此订阅者，失败时重试，最终失败时交给dead letter并返回错误
+func (sub *Subscription) deliver(u *Update) (err error) {
+	err = sub.withRetry(func() error {
+		return sub.call(u.Topic, func() error {
+			return sub.index.UpdateIndex(u.D, u.T, u.Props)
+		})
+	})
+	if err == nil {
+		return
+	}
+	return sub.fail(u, err)
+}
+
+func (sub *Subscription) withRetry(f func() error) (err error) {
+	for i := 0; ; i++ {
+		if err = f(); err == nil {
+			return
+		}
+		if i >= sub.retry {
+			return
+		}
+		if sub.backoff > 0 {
+			time.Sleep(sub.backoff)
+		}
+	}
+}
+
+// fail 将投递失败的更新交给dead letter
+func (sub *Subscription) fail(u *Update, err error) error {
+	updatesFailures.With(string(u.Topic)).Inc()
+	GetLogger().Error("utils.Updates deliver failed", "topic", u.Topic, "index", fmt.Sprintf("%T", sub.index), "err", err)
+
+	deadLetter := sub.deadLetter
+	if deadLetter == nil {
+		deadLetter = sub.bus.getDeadLetter()
+	}
+	if deadLetter != nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					GetLogger().Error("utils.Updates dead letter recover", "topic", u.Topic, "err", r, "stack", string(debug.Stack()))
+				}
+			}()
+			deadLetter(u, sub.index, err)
+		}()
+	}
+
+	return &UpdateError{
+		Index:  sub.index,
+		Update: u,
+		Err:    err,
+	}
+}
+
+func (sub *Subscription) call(topic Topic, f func() error) (err error) {
+	bt := time.Now()
 	defer func() {
-		AsyncTaskExit()
-		if err := recover(); err != nil {
-			fmt.Printf("lib.Updates recover err: %v, stack: %s\n", err, debug.Stack())
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			GetLogger().Error("utils.Updates recover", "topic", topic, "index", fmt.Sprintf("%T", sub.index), "err", r, "stack", string(debug.Stack()))
 		}
+		observeUpdateDelivery(topic, err, bt)
 	}()
-	for _, index := range indices {
-		index.UpdateIndex(d, t, props)
+	return f()
+}
+
+// Bus 订阅发布中心，注册/取消订阅与发布可以并发进行
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[Topic][]*Subscription
+
+	pendingMu   sync.Mutex
+	pendingCond *sync.Cond
+	pending     int
+
+	deadLetter DeadLetterFunc
+
+	nodeID    string
+	transport Transport
+	seen      *eventDedup
+
+	eventLog *EventLog
+	logMu    sync.Mutex // 设置了eventLog时保证写日志与投递的顺序一致
+}
+
+func NewBus() *Bus {
+	bus := &Bus{
+		subs:   make(map[Topic][]*Subscription),
+		nodeID: newNodeID(),
+		seen:   newEventDedup(time.Minute),
+	}
+	bus.pendingCond = sync.NewCond(&bus.pendingMu)
+	return bus
+}
+
+// DefaultBus Updates, RegisterIndex等方法使用
+var DefaultBus = NewBus()
+
+// Subscribe 订阅topic
+func (bus *Bus) Subscribe(topic Topic, index Index, opts ...SubscribeOption) *Subscription {
+	sub := &Subscription{
+		bus:   bus,
+		topic: topic,
+		index: index,
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	sub.start()
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	// copy on write，发布时无需持锁遍历
+	subs := make([]*Subscription, 0, len(bus.subs[topic])+1)
+	subs = append(subs, bus.subs[topic]...)
+	bus.subs[topic] = append(subs, sub)
+	return sub
+}
+
+func (bus *Bus) remove(sub *Subscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	subs := make([]*Subscription, 0, len(bus.subs[sub.topic]))
+	for _, s := range bus.subs[sub.topic] {
+		if s != sub {
+			subs = append(subs, s)
+		}
+	}
+	if len(subs) == 0 {
+		delete(bus.subs, sub.topic)
+		return
+	}
+	bus.subs[sub.topic] = subs
+}
+
+// SetDeadLetter 设置订阅者未单独设置时使用的dead letter
+func (bus *Bus) SetDeadLetter(f DeadLetterFunc) {
+	bus.mu.Lock()
+	bus.deadLetter = f
+	bus.mu.Unlock()
+}
+
+func (bus *Bus) getDeadLetter() DeadLetterFunc {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	return bus.deadLetter
+}
+
+// Publish 发布到topic，同步订阅者在返回前投递完，异步订阅者入队后返回，
+// 每个订阅者单独处理panic及错误，返回写事件日志及同步订阅者投递失败的聚合错误(MultiError)，
+// 设置了Transport时同时广播给其它实例
+func (bus *Bus) Publish(topic Topic, d interface{}, t UpdateType, props map[string]interface{}) error {
+	AsyncTaskEnter()
+	defer AsyncTaskExit()
+
+	u := &Update{
+		Topic: topic,
+		D:     d,
+		T:     t,
+		Props: props,
+	}
+
+	errs := bus.dispatch([]*Update{u})
+	if err := bus.broadcast(u); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.ErrorOrNil()
+}
+
+// dispatch 投递给本进程的订阅者，返回写事件日志及同步投递的错误
+func (bus *Bus) dispatch(us []*Update) (errs MultiError) {
+	if l := bus.getEventLog(); l != nil {
+		// 写日志与投递在同一把锁内，Replay可以得到与实时订阅者相同的状态
+		bus.logMu.Lock()
+		defer bus.logMu.Unlock()
+		if err := bus.record(l, us); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var topics []Topic
+	byTopic := make(map[Topic][]*Update)
+	for _, u := range us {
+		if _, ok := byTopic[u.Topic]; !ok {
+			topics = append(topics, u.Topic)
+		}
+		byTopic[u.Topic] = append(byTopic[u.Topic], u)
 	}
+
+	for _, topic := range topics {
+		bus.mu.RLock()
+		subs := bus.subs[topic]
+		bus.mu.RUnlock()
+
+		for _, sub := range subs {
+			var matched []*Update
+			for _, u := range byTopic[topic] {
+				if sub.match(u) {
+					matched = append(matched, u)
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+			errs = append(errs, sub.submit(matched)...)
+		}
+	}
+	return
+}
+
+// Wait 等待已发布的更新全部投递完
+func (bus *Bus) Wait() {
+	bus.pendingMu.Lock()
+	for bus.pending > 0 {
+		bus.pendingCond.Wait()
+	}
+	bus.pendingMu.Unlock()
+}
+
+func (bus *Bus) enter() {
+	AsyncTaskEnter()
+	bus.pendingMu.Lock()
+	bus.pending++
+	bus.pendingMu.Unlock()
+}
+
+func (bus *Bus) exit() {
+	bus.pendingMu.Lock()
+	if bus.pending--; bus.pending <= 0 {
+		bus.pendingCond.Broadcast()
+	}
+	bus.pendingMu.Unlock()
+	AsyncTaskExit()
+}
+
+func Updates(d interface{}, t UpdateType, props map[string]interface{}) error {
+	return DefaultBus.Publish(DefaultTopic, d, t, props)
+}
+
+// RegisterIndex 订阅DefaultTopic，可通过返回值取消订阅
+func RegisterIndex(index Index, opts ...SubscribeOption) *Subscription {
+	return DefaultBus.Subscribe(DefaultTopic, index, opts...)
+}
+
+// Publish 发布到DefaultBus的topic
+func Publish(topic Topic, d interface{}, t UpdateType, props map[string]interface{}) error {
+	return DefaultBus.Publish(topic, d, t, props)
+}
+
+// Subscribe 订阅DefaultBus的topic
+func Subscribe(topic Topic, index Index, opts ...SubscribeOption) *Subscription {
+	return DefaultBus.Subscribe(topic, index, opts...)
 }
 
-func RegisterIndex(index Index) {
-	indices = append(indices, index)
+// WaitUpdates 等待DefaultBus上已发布的更新全部投递完
+func WaitUpdates() {
+	DefaultBus.Wait()
 }
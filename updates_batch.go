@@ -0,0 +1,111 @@
+// 此文件定义Updates的批量发布及合并投递
+
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// BatchIndex 批量订阅者，UpdatesBatch及合并投递时一次收到全部(经过过滤的)更新
+type BatchIndex interface {
+	Index
+	UpdateIndexBatch(us []*Update) error
+}
+
+// WithCoalesce 将window时间内的更新合并后一次投递，key相同的更新只保留最后一次，
+// key为nil时不合并只攒批，投递在window结束后进行，因此发布方拿不到投递错误
+func WithCoalesce(window time.Duration, key func(*Update) string) SubscribeOption {
+	return func(sub *Subscription) {
+		sub.coalesceWindow = window
+		sub.coalesceKey = key
+	}
+}
+
+type coalescer struct {
+	sub *Subscription
+
+	mu    sync.Mutex
+	us    []*Update
+	pos   map[string]int
+	timer *time.Timer
+}
+
+func newCoalescer(sub *Subscription) *coalescer {
+	return &coalescer{
+		sub: sub,
+		pos: make(map[string]int),
+	}
+}
+
+func (c *coalescer) add(us []*Update) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.us) == 0 {
+		c.sub.bus.enter()
+		c.timer = time.AfterFunc(c.sub.coalesceWindow, c.flush)
+	}
+
+	for _, u := range us {
+		if c.sub.coalesceKey == nil {
+			c.us = append(c.us, u)
+			continue
+		}
+
+		key := c.sub.coalesceKey(u)
+		if i, ok := c.pos[key]; ok {
+			c.us[i] = u
+			continue
+		}
+		c.pos[key] = len(c.us)
+		c.us = append(c.us, u)
+	}
+}
+
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	us := c.us
+	c.us = nil
+	c.pos = make(map[string]int)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+
+	if len(us) == 0 {
+		return
+	}
+
+	defer c.sub.bus.exit()
+	if c.sub.async {
+		c.sub.enqueue(us)
+		return
+	}
+	c.sub.deliverBatch(us)
+}
+
+// PublishBatch 批量发布，实现了BatchIndex的订阅者一次收到全部更新，其它订阅者逐个收到，
+// 返回写事件日志及同步订阅者投递失败的聚合错误(MultiError)
+func (bus *Bus) PublishBatch(us []*Update) error {
+	if len(us) == 0 {
+		return nil
+	}
+
+	AsyncTaskEnter()
+	defer AsyncTaskExit()
+
+	errs := bus.dispatch(us)
+	for _, u := range us {
+		if err := bus.broadcast(u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// UpdatesBatch 批量发布到DefaultBus，Update.Topic为空时即DefaultTopic
+func UpdatesBatch(us []*Update) error {
+	return DefaultBus.PublishBatch(us)
+}
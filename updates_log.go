@@ -0,0 +1,403 @@
+// 此文件定义Updates的事件日志，发布的更新按序号追加到本地文件，
+// 新增或重建的Index可以通过快照加Replay追上之前的更新
+
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const eventLogFile = "events.log"
+
+var ErrNoEventLog = errors.New("event log not set")
+
+// Snapshotter 可以保存及恢复状态的Index
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore([]byte) error
+}
+
+type eventLogRecord struct {
+	Seq   uint64 `json:"seq"`
+	Event *Event `json:"event"`
+}
+
+type eventLogSnapshot struct {
+	Seq  uint64 `json:"seq"`
+	Data []byte `json:"data"`
+}
+
+// EventLog 更新事件日志，d的还原依赖RegisterEventType
+type EventLog struct {
+	dir    string
+	noSync bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64 // file中已写入成功的记录的总长度
+	seq  uint64
+}
+
+// OpenEventLog 打开(或创建)dir下的事件日志，noSync为true时写入后不fsync，
+// 末尾不完整的记录(写入时进程退出)会被截掉
+func OpenEventLog(dir string, noSync bool) (l *EventLog, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, eventLogFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	l = &EventLog{
+		dir:    dir,
+		noSync: noSync,
+		file:   file,
+	}
+	valid, err := l.scanLocked(0, func(record *eventLogRecord) error {
+		l.seq = record.Seq
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fi.Size() > valid {
+		GetLogger().Warn("utils.EventLog truncate torn record", "dir", dir, "size", fi.Size(), "valid", valid)
+		if err = file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	l.size = valid
+	return
+}
+
+// Seq 返回最后一条事件的序号，从1开始，0表示没有事件
+func (l *EventLog) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Append 追加更新，写入成功后设置每个Update的Seq，返回最后一条的序号，
+// 写入失败时截掉已写入的部分，不影响之后追加的记录
+func (l *EventLog) Append(us ...*Update) (seq uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf []byte
+	seq = l.seq
+	for _, u := range us {
+		e, err := EncodeEvent(u)
+		if err != nil {
+			return l.seq, err
+		}
+		seq++
+		bs, err := json.Marshal(&eventLogRecord{Seq: seq, Event: e})
+		if err != nil {
+			return l.seq, err
+		}
+		buf = append(append(buf, bs...), '\n')
+	}
+
+	_, err = l.file.Write(buf)
+	if err == nil && !l.noSync {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		if e := l.file.Truncate(l.size); e != nil {
+			GetLogger().Error("utils.EventLog rollback error", "dir", l.dir, "size", l.size, "err", e)
+		}
+		return l.seq, err
+	}
+	for i, u := range us {
+		u.Seq = l.seq + uint64(i) + 1
+	}
+	l.seq = seq
+	l.size += int64(len(buf))
+	return
+}
+
+// ReplayFunc 按序号顺序回放序号>=fromSeq的事件，fn返回error时停止
+func (l *EventLog) ReplayFunc(fromSeq uint64, fn func(seq uint64, u *Update) error) error {
+	return l.scan(fromSeq, func(record *eventLogRecord) error {
+		u, err := DecodeEvent(record.Event)
+		if err != nil {
+			return fmt.Errorf("event log decode seq %d: %v", record.Seq, err)
+		}
+		u.Seq = record.Seq
+		return fn(record.Seq, u)
+	})
+}
+
+// Replay 将topic上序号>=fromSeq的事件按顺序投递给index，opts里的WithUpdateTypes,
+// WithDataType及WithFilter与订阅时一样用于过滤，其它选项被忽略，
+// 返回读到的最后一条事件的序号(包括被过滤的)
+func (l *EventLog) Replay(fromSeq uint64, topic Topic, index Index, opts ...SubscribeOption) (last uint64, err error) {
+	sub := &Subscription{topic: topic}
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	err = l.ReplayFunc(fromSeq, func(seq uint64, u *Update) error {
+		last = seq
+		if u.Topic != topic || !sub.match(u) {
+			return nil
+		}
+		if err := index.UpdateIndex(u.D, u.T, u.Props); err != nil {
+			return fmt.Errorf("event log replay seq %d: %v", seq, err)
+		}
+		return nil
+	})
+	return
+}
+
+// SaveSnapshot 保存名为name的快照，seq为s已应用的最后一条事件的序号，
+// 订阅是异步或合并投递的，投递晚于写入日志，不能直接使用Seq()，
+// 可以在BatchIndex里记录收到的Update.Seq，或者使用Replay/Restore的返回值
+func (l *EventLog) SaveSnapshot(name string, seq uint64, s Snapshotter) (err error) {
+	data, err := s.Snapshot()
+	if err != nil {
+		return
+	}
+
+	bs, err := json.Marshal(&eventLogSnapshot{Seq: seq, Data: data})
+	if err != nil {
+		return
+	}
+
+	path := l.snapshotPath(name)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	return
+}
+
+// Restore 从名为name的快照恢复s，再回放topic上快照之后的事件到index，没有快照时从头回放，
+// opts同Replay
+func (l *EventLog) Restore(name string, topic Topic, s Snapshotter, index Index, opts ...SubscribeOption) (last uint64, err error) {
+	bs, err := ioutil.ReadFile(l.snapshotPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	var fromSeq uint64
+	if err == nil {
+		snapshot := &eventLogSnapshot{}
+		if err = json.Unmarshal(bs, snapshot); err != nil {
+			return
+		}
+		if err = s.Restore(snapshot.Data); err != nil {
+			return
+		}
+		fromSeq, last = snapshot.Seq+1, snapshot.Seq
+	}
+
+	replayed, err := l.Replay(fromSeq, topic, index, opts...)
+	if replayed > last {
+		last = replayed
+	}
+	return
+}
+
+// Compact 删除序号<beforeSeq的事件，调用方需保证相关快照已覆盖这些事件，
+// 最后一条事件总会保留，重新打开后据此恢复序号
+func (l *EventLog) Compact(beforeSeq uint64) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	path := filepath.Join(l.dir, eventLogFile)
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(out)
+	var size int64
+	_, err = l.scanLocked(0, func(record *eventLogRecord) error {
+		if record.Seq < beforeSeq && record.Seq != l.seq {
+			return nil
+		}
+		bs, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		size += int64(len(bs)) + 1
+		w.Write(bs)
+		return w.WriteByte('\n')
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	l.file.Close()
+	l.file, l.size = file, size
+	return
+}
+
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *EventLog) snapshotPath(name string) string {
+	return filepath.Join(l.dir, "snapshot-"+name+".json")
+}
+
+// scan 只在打开文件时持有锁，读取打开时已写入成功的记录，fn里可以继续Append，
+// 期间Compact替换的文件不影响已打开的文件
+func (l *EventLog) scan(fromSeq uint64, fn func(*eventLogRecord) error) error {
+	l.mu.Lock()
+	f, err := os.Open(filepath.Join(l.dir, eventLogFile))
+	size := l.size
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = scanEventLog(io.LimitReader(f, size), fromSeq, fn)
+	return err
+}
+
+// scanLocked 调用者需持有l.mu
+func (l *EventLog) scanLocked(fromSeq uint64, fn func(*eventLogRecord) error) (valid int64, err error) {
+	f, err := os.Open(filepath.Join(l.dir, eventLogFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return scanEventLog(f, fromSeq, fn)
+}
+
+// scanEventLog 读取序号>=fromSeq的完整记录，末尾不完整的行会被忽略，返回完整记录的总长度
+func scanEventLog(r io.Reader, fromSeq uint64, fn func(*eventLogRecord) error) (valid int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+
+		record := &eventLogRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return valid, fmt.Errorf("event log bad record: %v", err)
+		}
+		valid += int64(len(line))
+		if record.Seq < fromSeq {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return valid, err
+		}
+	}
+}
+
+// SetEventLog 设置事件日志，之后本进程发布及收到的更新都会先写入日志，
+// 写日志与投递(同步订阅者的投递及异步订阅者的入队)串行进行，投递顺序与日志里的序号一致，
+// 写日志失败时仍继续投递，错误加入Publish及PublishBatch返回的MultiError，此时日志里缺少这些更新，
+// 订阅者不能在投递中同步发布到同一Bus，否则会死锁
+func (bus *Bus) SetEventLog(l *EventLog) {
+	bus.mu.Lock()
+	bus.eventLog = l
+	bus.mu.Unlock()
+}
+
+func (bus *Bus) getEventLog() *EventLog {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	return bus.eventLog
+}
+
+// record 写入事件日志，调用者需持有bus.logMu
+func (bus *Bus) record(l *EventLog, us []*Update) error {
+	if _, err := l.Append(us...); err != nil {
+		GetLogger().Error("utils.Updates event log append error", "dir", l.dir, "err", err)
+		return fmt.Errorf("event log append: %v", err)
+	}
+	return nil
+}
+
+// SubscribeFrom 先将事件日志里topic上序号>=fromSeq的事件回放给index，再订阅topic，
+// 回放与订阅之间发布的事件不会丢失也不会重复投递，opts同Subscribe，也用于回放时的过滤，
+// 返回回放时读到的最后一条事件的序号，没有设置事件日志时返回ErrNoEventLog
+func (bus *Bus) SubscribeFrom(fromSeq uint64, topic Topic, index Index, opts ...SubscribeOption) (sub *Subscription, last uint64, err error) {
+	l := bus.getEventLog()
+	if l == nil {
+		err = ErrNoEventLog
+		return
+	}
+
+	// 先不阻塞发布回放已有的事件，再阻塞发布回放剩余的事件并订阅
+	if last, err = l.Replay(fromSeq, topic, index, opts...); err != nil {
+		return
+	}
+	if last >= fromSeq {
+		fromSeq = last + 1
+	}
+
+	bus.logMu.Lock()
+	defer bus.logMu.Unlock()
+
+	rest, err := l.Replay(fromSeq, topic, index, opts...)
+	if rest > last {
+		last = rest
+	}
+	if err != nil {
+		return
+	}
+	sub = bus.Subscribe(topic, index, opts...)
+	return
+}
+
+// SetEventLog 设置DefaultBus的事件日志
+func SetEventLog(l *EventLog) {
+	DefaultBus.SetEventLog(l)
+}
+
+// SubscribeFrom 回放DefaultBus的事件日志后订阅topic
+func SubscribeFrom(fromSeq uint64, topic Topic, index Index, opts ...SubscribeOption) (*Subscription, uint64, error) {
+	return DefaultBus.SubscribeFrom(fromSeq, topic, index, opts...)
+}
@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type logItem struct {
+	ID int
+}
+
+// logCounter 按id记录当前存在的item
+type logCounter map[int]bool
+
+func (lc logCounter) UpdateIndex(d interface{}, t UpdateType, props map[string]interface{}) error {
+	item := d.(*logItem)
+	if t == DELETE {
+		delete(lc, item.ID)
+		return nil
+	}
+	lc[item.ID] = true
+	return nil
+}
+
+func (lc logCounter) Snapshot() ([]byte, error) {
+	return json.Marshal(lc)
+}
+
+func (lc logCounter) Restore(data []byte) error {
+	return json.Unmarshal(data, &lc)
+}
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	RegisterEventType(&logItem{})
+
+	l, err := OpenEventLog(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewBus()
+	bus.SetEventLog(l)
+
+	live := logCounter{}
+	bus.Subscribe(DefaultTopic, live)
+	for i := 1; i <= 5; i++ {
+		bus.Publish(DefaultTopic, &logItem{ID: i}, ADD, nil)
+	}
+	bus.Publish(DefaultTopic, &logItem{ID: 2}, DELETE, nil)
+
+	// 同步订阅者在Publish返回前已应用全部事件
+	if err := l.SaveSnapshot("live", l.Seq(), live); err != nil {
+		t.Fatal(err)
+	}
+	us := []*Update{
+		{D: &logItem{ID: 6}, T: ADD},
+		{D: &logItem{ID: 1}, T: DELETE},
+		{Topic: "other", D: &logItem{ID: 100}, T: ADD},
+	}
+	bus.PublishBatch(us)
+	if us[0].Seq != 7 || us[2].Seq != 9 {
+		t.Fatalf("update seq: %d, %d", us[0].Seq, us[2].Seq)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后从头回放
+	l, err = OpenEventLog(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq := l.Seq(); seq != 9 {
+		t.Fatalf("seq after reopen: %d", seq)
+	}
+
+	// 其它topic及被过滤的事件不会回放
+	replayed := logCounter{}
+	if last, err := l.Replay(0, DefaultTopic, replayed); err != nil || last != 9 {
+		t.Fatalf("replay last: %d, err: %v", last, err)
+	}
+	if len(replayed) != len(live) {
+		t.Fatalf("replayed: %v, live: %v", replayed, live)
+	}
+	for id := range live {
+		if !replayed[id] {
+			t.Fatalf("replayed: %v, live: %v", replayed, live)
+		}
+	}
+	filtered := logCounter{}
+	if _, err := l.Replay(0, DefaultTopic, filtered, WithUpdateTypes(DELETE)); err != nil || len(filtered) != 0 {
+		t.Fatalf("filtered: %v, err: %v", filtered, err)
+	}
+
+	// 压缩后通过快照恢复
+	if err := l.Compact(7); err != nil {
+		t.Fatal(err)
+	}
+	restored := logCounter{}
+	if last, err := l.Restore("live", DefaultTopic, restored, restored); err != nil || last != 9 {
+		t.Fatalf("restore last: %d, err: %v", last, err)
+	}
+	if len(restored) != 4 || restored[1] || restored[2] || !restored[6] {
+		t.Fatalf("restored: %v", restored)
+	}
+
+	// 全部压缩后重新打开，序号不会从0开始
+	if err := l.Compact(l.Seq() + 1); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if l, err = OpenEventLog(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if seq := l.Seq(); seq != 9 {
+		t.Fatalf("seq after compact: %d", seq)
+	}
+
+	// 末尾不完整的记录在打开时被截掉，不会与之后追加的记录连在一起
+	l.Close()
+	f, err := os.OpenFile(filepath.Join(dir, eventLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":10,"ev`)
+	f.Close()
+	if l, err = OpenEventLog(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq, err := l.Append(&Update{Topic: DefaultTopic, D: &logItem{ID: 7}, T: ADD}); err != nil || seq != 10 {
+		t.Fatalf("append seq: %d, err: %v", seq, err)
+	}
+	tail := logCounter{}
+	if last, err := l.Replay(10, DefaultTopic, tail); err != nil || last != 10 || !tail[7] {
+		t.Fatalf("replay after torn record: %d, %v, err: %v", last, tail, err)
+	}
+}
+
+func TestEventLogOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	RegisterEventType(&logItem{})
+
+	l, err := OpenEventLog(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	bus := NewBus()
+	bus.SetEventLog(l)
+
+	// 实时订阅者收到的顺序与回放的顺序一致
+	var mu sync.Mutex
+	var live []int
+	bus.Subscribe(DefaultTopic, IndexFunc(func(d interface{}, t UpdateType, props map[string]interface{}) error {
+		mu.Lock()
+		live = append(live, d.(*logItem).ID)
+		mu.Unlock()
+		return nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				bus.Publish(DefaultTopic, &logItem{ID: i*100 + j}, ADD, nil)
+			}
+		}(i)
+	}
+
+	// 回放时fn里可以继续写入
+	if err := l.ReplayFunc(0, func(seq uint64, u *Update) error {
+		_, err := l.Append(&Update{Topic: "replay", D: &logItem{}, T: GET})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	var replayed []int
+	if _, err := l.Replay(0, DefaultTopic, IndexFunc(func(d interface{}, t UpdateType, props map[string]interface{}) error {
+		replayed = append(replayed, d.(*logItem).ID)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 200 || len(live) != 200 {
+		t.Fatalf("replayed: %d, live: %d", len(replayed), len(live))
+	}
+	for i := range live {
+		if live[i] != replayed[i] {
+			t.Fatalf("order differs at %d: live %d, replayed %d", i, live[i], replayed[i])
+		}
+	}
+}
+
+func TestBusSubscribeFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	RegisterEventType(&logItem{})
+
+	bus := NewBus()
+	if _, _, err := bus.SubscribeFrom(0, DefaultTopic, logCounter{}); err != ErrNoEventLog {
+		t.Fatalf("without event log: %v", err)
+	}
+
+	l, err := OpenEventLog(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	bus.SetEventLog(l)
+
+	for i := 0; i < 100; i++ {
+		bus.Publish(DefaultTopic, &logItem{ID: i}, ADD, nil)
+	}
+
+	// 回放及订阅期间继续发布，每个事件恰好收到一次
+	stop := make(chan bool)
+	published := make(chan int)
+	go func() {
+		i := 100
+		defer func() { published <- i }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			bus.Publish(DefaultTopic, &logItem{ID: i}, ADD, nil)
+			i++
+		}
+	}()
+
+	var mu sync.Mutex
+	got := make(map[int]int)
+	sub, last, err := bus.SubscribeFrom(0, DefaultTopic, IndexFunc(func(d interface{}, t UpdateType, props map[string]interface{}) error {
+		mu.Lock()
+		got[d.(*logItem).ID]++
+		mu.Unlock()
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	if last < 100 {
+		t.Fatalf("last: %d", last)
+	}
+	close(stop)
+	n := <-published
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != n {
+		t.Fatalf("got: %d, published: %d", len(got), n)
+	}
+	for id, c := range got {
+		if c != 1 {
+			t.Fatalf("id %d delivered %d times", id, c)
+		}
+	}
+}
+
+func TestBusEventLogAppendError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	RegisterEventType(&logItem{})
+
+	l, err := OpenEventLog(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewBus()
+	bus.SetEventLog(l)
+	lc := logCounter{}
+	bus.Subscribe(DefaultTopic, lc)
+
+	// 日志已关闭，写入失败时返回错误，仍继续投递
+	l.Close()
+	if err := bus.Publish(DefaultTopic, &logItem{ID: 1}, ADD, nil); err == nil {
+		t.Fatal("expected append error from Publish")
+	}
+	if err := bus.PublishBatch([]*Update{{Topic: DefaultTopic, D: &logItem{ID: 2}, T: ADD}}); err == nil {
+		t.Fatal("expected append error from PublishBatch")
+	}
+	if !lc[1] || !lc[2] {
+		t.Fatalf("not delivered: %v", lc)
+	}
+}
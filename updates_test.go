@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	async := bus.Subscribe("t", IndexFunc(func(d interface{}, typ UpdateType, props map[string]interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		key := props["key"].(string)
+		got[key] = append(got[key], d.(int))
+		return nil
+	}), WithAsync(4), WithOrderKey(3, func(u *Update) string {
+		return u.Props["key"].(string)
+	}))
+
+	var syncN int
+	sub := bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		syncN++
+		return nil
+	}))
+	bus.Subscribe("other", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		t.Error("unexpected topic")
+		return nil
+	}))
+
+	for i := 0; i < 100; i++ {
+		key := []string{"a", "b", "c", "d"}[i%4]
+		bus.Publish("t", i, ADD, map[string]interface{}{"key": key})
+	}
+	bus.Wait()
+
+	if syncN != 100 {
+		t.Fatalf("sync delivered: %d", syncN)
+	}
+	for key, ds := range got {
+		if len(ds) != 25 {
+			t.Fatalf("key %s delivered: %d", key, len(ds))
+		}
+		for i := 1; i < len(ds); i++ {
+			if ds[i] <= ds[i-1] {
+				t.Fatalf("key %s out of order: %v", key, ds)
+			}
+		}
+	}
+
+	sub.Unsubscribe()
+	async.Unsubscribe()
+	bus.Publish("t", 0, ADD, map[string]interface{}{"key": "a"})
+	bus.Wait()
+	if syncN != 100 || len(got["a"]) != 25 {
+		t.Fatal("delivered after unsubscribe")
+	}
+}
+
+func TestBusAsyncQueueFull(t *testing.T) {
+	bus := NewBus()
+
+	// WithOrderKey隐含异步，队列长度为0
+	release := make(chan bool)
+	sub := bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		<-release
+		return nil
+	}), WithOrderKey(1, func(*Update) string { return "" }))
+
+	bus.Publish("t", 1, ADD, nil)
+
+	// 队列满时阻塞的发布者不影响Unsubscribe之后的发布
+	blocked := make(chan bool)
+	go func() {
+		bus.Publish("t", 2, ADD, nil)
+		close(blocked)
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	unsubscribed := make(chan bool)
+	go func() {
+		sub.Unsubscribe()
+		close(unsubscribed)
+	}()
+	waitFor(t, func() bool {
+		sub.mu.RLock()
+		defer sub.mu.RUnlock()
+		return sub.closed
+	})
+	sub.enqueue([]*Update{{Topic: "t", D: 3}})
+
+	close(release)
+	<-blocked
+	<-unsubscribed
+	bus.Wait()
+}
+
+func TestBusErrorIsolation(t *testing.T) {
+	bus := NewBus()
+
+	var dead []error
+	bus.SetDeadLetter(func(u *Update, index Index, err error) {
+		dead = append(dead, err)
+	})
+
+	bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		panic("boom")
+	}))
+
+	var attempts int
+	bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("retry")
+		}
+		return nil
+	}), WithRetry(2, 0))
+
+	var delivered bool
+	bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		delivered = true
+		return nil
+	}))
+
+	err := bus.Publish("t", 1, ADD, nil)
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("publish err: %v", err)
+	}
+	if !delivered || attempts != 3 || len(dead) != 1 {
+		t.Fatalf("delivered: %v, attempts: %d, dead: %v", delivered, attempts, dead)
+	}
+}
+
+func TestBusFilter(t *testing.T) {
+	bus := NewBus()
+
+	type user struct{}
+	var got []UpdateType
+	bus.Subscribe("t", IndexFunc(func(d interface{}, typ UpdateType, props map[string]interface{}) error {
+		got = append(got, typ)
+		return nil
+	}), WithUpdateTypes(ADD, DELETE), WithDataType((*user)(nil)), WithFilter(func(props map[string]interface{}) bool {
+		return props["skip"] == nil
+	}))
+
+	bus.Publish("t", &user{}, ADD, nil)
+	bus.Publish("t", &user{}, UPDATE, nil)
+	bus.Publish("t", user{}, ADD, nil)
+	bus.Publish("t", &user{}, DELETE, map[string]interface{}{"skip": true})
+	bus.Publish("t", &user{}, DELETE, nil)
+
+	if len(got) != 2 || got[0] != ADD || got[1] != DELETE {
+		t.Fatalf("got: %v", got)
+	}
+}
+
+func TestBusUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type user struct {
+		Name string
+	}
+	RegisterEventType(&user{})
+
+	var buses []*Bus
+	got := make(chan *user, 4)
+	for i := 0; i < 3; i++ {
+		bus := NewBus()
+		if err := bus.SetTransport(NewUnixTransport(dir)); err != nil {
+			t.Fatal(err)
+		}
+		defer bus.SetTransport(nil)
+		bus.Subscribe("t", IndexFunc(func(d interface{}, typ UpdateType, props map[string]interface{}) error {
+			got <- d.(*user)
+			return nil
+		}))
+		buses = append(buses, bus)
+	}
+
+	if err := buses[0].Publish("t", &user{Name: "a"}, ADD, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case u := <-got:
+			if u.Name != "a" {
+				t.Fatalf("got: %v", u)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received %d events", i)
+		}
+	}
+
+	// 重复的事件及自己发出的事件会被忽略
+	e, err := EncodeEvent(&Update{Topic: "t", D: &user{Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ID, e.Origin = "dup", "other"
+	buses[1].receive(e)
+	buses[1].receive(e)
+	e.ID, e.Origin = "self", buses[1].NodeID()
+	buses[1].receive(e)
+	select {
+	case <-got:
+	default:
+		t.Fatal("event not delivered")
+	}
+	select {
+	case u := <-got:
+		t.Fatalf("unexpected event: %v", u)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	recv := NewHTTPTransport(nil, 0)
+	recv.Secret, recv.MaxBodySize = "s3cret", 256
+	got := make(chan *Event, 1)
+	recv.Start(func(e *Event) { got <- e })
+	ts := httptest.NewServer(recv)
+	defer ts.Close()
+
+	send := NewHTTPTransport([]string{ts.URL}, time.Second)
+	if err := send.Send(&Event{ID: "1", Topic: "t"}); err == nil {
+		t.Fatal("event without secret accepted")
+	}
+
+	send.Secret = recv.Secret
+	if err := send.Send(&Event{ID: "2", Topic: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-got; e.ID != "2" {
+		t.Fatalf("got: %v", e)
+	}
+
+	// 超过MaxBodySize的请求被拒绝
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(`{"id":"3","type":"`+strings.Repeat("x", 512)+`"}`))
+	req.Header.Set(HTTPTransportSecretHeader, recv.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status: %d", resp.StatusCode)
+	}
+
+	// 未设置Secret时只接收内网请求
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"id":"4"}`))
+	r.RemoteAddr = "8.8.8.8:1234"
+	NewHTTPTransport(nil, 0).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status: %d", w.Code)
+	}
+}
+
+type batchIndex struct {
+	mu      sync.Mutex
+	batches [][]*Update
+}
+
+func (bi *batchIndex) UpdateIndex(d interface{}, t UpdateType, props map[string]interface{}) error {
+	return bi.UpdateIndexBatch([]*Update{{D: d, T: t, Props: props}})
+}
+
+func (bi *batchIndex) UpdateIndexBatch(us []*Update) error {
+	bi.mu.Lock()
+	bi.batches = append(bi.batches, us)
+	bi.mu.Unlock()
+	return nil
+}
+
+func TestBusBatch(t *testing.T) {
+	bus := NewBus()
+
+	bi := &batchIndex{}
+	bus.Subscribe("t", bi)
+
+	var n int
+	bus.Subscribe("t", IndexFunc(func(interface{}, UpdateType, map[string]interface{}) error {
+		n++
+		return nil
+	}))
+
+	coalesced := &batchIndex{}
+	bus.Subscribe("t", coalesced, WithCoalesce(time.Millisecond*20, func(u *Update) string {
+		return u.D.(string)
+	}))
+
+	us := []*Update{
+		{Topic: "t", D: "a", T: ADD},
+		{Topic: "t", D: "b", T: ADD},
+		{Topic: "other", D: "c", T: ADD},
+		{Topic: "t", D: "a", T: DELETE},
+	}
+	if err := bus.PublishBatch(us); err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish("t", "b", UPDATE, nil)
+	bus.Wait()
+
+	if len(bi.batches) != 2 || len(bi.batches[0]) != 3 || n != 4 {
+		t.Fatalf("batches: %v, n: %d", bi.batches, n)
+	}
+	if len(coalesced.batches) != 1 {
+		t.Fatalf("coalesced batches: %v", coalesced.batches)
+	}
+	got := coalesced.batches[0]
+	if len(got) != 2 || got[0].D != "a" || got[0].T != DELETE || got[1].D != "b" || got[1].T != UPDATE {
+		t.Fatalf("coalesced: %v", got)
+	}
+}
@@ -0,0 +1,425 @@
+// 此文件定义Updates的跨进程广播，多个实例之间同步ADD/DELETE/UPDATE等更新，
+// 收到的更新只投递给本进程订阅者，不会再次广播，从而避免循环
+
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Event 跨进程传输的更新，d及props使用json序列化，
+// 接收方props里的数字会变为float64
+type Event struct {
+	ID     string                 `json:"id"`
+	Origin string                 `json:"origin"`
+	Topic  Topic                  `json:"topic"`
+	T      UpdateType             `json:"t"`
+	Type   string                 `json:"type,omitempty"`
+	D      json.RawMessage        `json:"d,omitempty"`
+	Props  map[string]interface{} `json:"props,omitempty"`
+}
+
+// Transport 跨进程传输方式
+type Transport interface {
+	// Send 发送给其它实例
+	Send(*Event) error
+	// Start 开始接收，收到的事件交给recv处理
+	Start(recv func(*Event)) error
+	Close() error
+}
+
+var eventTypes sync.Map
+
+// RegisterEventType 注册d的类型，接收方据此将d还原为原类型，未注册的类型还原为json.RawMessage
+func RegisterEventType(sample interface{}) {
+	typ := reflect.TypeOf(sample)
+	eventTypes.Store(typ.String(), typ)
+}
+
+// EncodeEvent 将更新序列化为Event
+func EncodeEvent(u *Update) (e *Event, err error) {
+	e = &Event{
+		Topic: u.Topic,
+		T:     u.T,
+		Props: u.Props,
+	}
+	if u.D != nil {
+		e.Type = reflect.TypeOf(u.D).String()
+		if e.D, err = json.Marshal(u.D); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// DecodeEvent 将Event还原为更新
+func DecodeEvent(e *Event) (u *Update, err error) {
+	u = &Update{
+		Topic: e.Topic,
+		T:     e.T,
+		Props: e.Props,
+	}
+	if len(e.D) == 0 {
+		return
+	}
+
+	v, ok := eventTypes.Load(e.Type)
+	if !ok {
+		u.D = e.D
+		return
+	}
+
+	typ := v.(reflect.Type)
+	if typ.Kind() == reflect.Ptr {
+		ptr := reflect.New(typ.Elem())
+		if err = json.Unmarshal(e.D, ptr.Interface()); err != nil {
+			return nil, err
+		}
+		u.D = ptr.Interface()
+		return
+	}
+
+	ptr := reflect.New(typ)
+	if err = json.Unmarshal(e.D, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	u.D = ptr.Elem().Interface()
+	return
+}
+
+var eventSeq int64
+
+func newNodeID() string {
+	return fmt.Sprintf("%s-%d-%d", LocalIp, os.Getpid(), time.Now().UnixNano())
+}
+
+// eventDedup 记录最近ttl~2*ttl时间内收到的事件id
+type eventDedup struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	rotated time.Time
+	cur     map[string]bool
+	prev    map[string]bool
+}
+
+func newEventDedup(ttl time.Duration) *eventDedup {
+	return &eventDedup{
+		ttl:     ttl,
+		rotated: time.Now(),
+		cur:     make(map[string]bool),
+		prev:    make(map[string]bool),
+	}
+}
+
+// seen 返回id是否已出现过，并记录id
+func (dd *eventDedup) seen(id string) bool {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	if now := time.Now(); now.Sub(dd.rotated) > dd.ttl {
+		dd.prev, dd.cur = dd.cur, make(map[string]bool)
+		dd.rotated = now
+	}
+
+	if dd.cur[id] || dd.prev[id] {
+		return true
+	}
+	dd.cur[id] = true
+	return false
+}
+
+// NodeID 返回本实例标识，用于识别自己发出的事件
+func (bus *Bus) NodeID() string {
+	return bus.nodeID
+}
+
+// SetTransport 设置跨进程传输方式并开始接收，传nil时关闭当前传输
+func (bus *Bus) SetTransport(t Transport) (err error) {
+	bus.mu.Lock()
+	old := bus.transport
+	bus.transport = t
+	bus.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	if t != nil {
+		err = t.Start(bus.receive)
+	}
+	return
+}
+
+func (bus *Bus) getTransport() Transport {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	return bus.transport
+}
+
+func (bus *Bus) broadcast(u *Update) (err error) {
+	t := bus.getTransport()
+	if t == nil {
+		return
+	}
+
+	e, err := EncodeEvent(u)
+	if err != nil {
+		return fmt.Errorf("encode event, topic: %q: %v", u.Topic, err)
+	}
+	e.Origin = bus.nodeID
+	e.ID = fmt.Sprintf("%s-%d", bus.nodeID, atomic.AddInt64(&eventSeq, 1))
+	bus.seen.seen(e.ID)
+
+	if err = t.Send(e); err != nil {
+		GetLogger().Error("utils.Updates broadcast error", "topic", u.Topic, "id", e.ID, "err", err)
+	}
+	return
+}
+
+// receive 处理其它实例发来的事件，只投递给本进程订阅者
+func (bus *Bus) receive(e *Event) {
+	if e.Origin == bus.nodeID || bus.seen.seen(e.ID) {
+		return
+	}
+
+	u, err := DecodeEvent(e)
+	if err != nil {
+		GetLogger().Error("utils.Updates decode event error", "id", e.ID, "origin", e.Origin, "err", err)
+		return
+	}
+
+	AsyncTaskEnter()
+	defer AsyncTaskExit()
+
+	if err := bus.dispatch([]*Update{u}).ErrorOrNil(); err != nil {
+		GetLogger().Warn("utils.Updates remote event deliver failed", "id", e.ID, "origin", e.Origin, "err", err)
+	}
+}
+
+// SetTransport 设置DefaultBus的跨进程传输方式
+func SetTransport(t Transport) error {
+	return DefaultBus.SetTransport(t)
+}
+
+// HTTPTransportSecretHeader HTTPTransport传递共享密钥的header
+const HTTPTransportSecretHeader = "X-Updates-Secret"
+
+// HTTPTransport 通过http把事件POST给其它实例，本实例需挂载HTTPTransport(实现了http.Handler)接收，
+// 设置了Secret时只接收带相同密钥的请求，否则只接收内网及本机的请求
+type HTTPTransport struct {
+	Timeout     time.Duration
+	Secret      string // 各实例之间的共享密钥
+	MaxBodySize int64  // 接收事件的最大长度，<=0时为1M
+
+	mu    sync.RWMutex
+	peers []string
+	recv  func(*Event)
+}
+
+// NewHTTPTransport peers为其它实例接收事件的地址，比如http://10.0.0.2:8080/_updates
+func NewHTTPTransport(peers []string, timeout time.Duration) *HTTPTransport {
+	return &HTTPTransport{
+		Timeout: timeout,
+		peers:   peers,
+	}
+}
+
+// SetPeers 更新其它实例地址
+func (t *HTTPTransport) SetPeers(peers []string) {
+	t.mu.Lock()
+	t.peers = peers
+	t.mu.Unlock()
+}
+
+func (t *HTTPTransport) Send(e *Event) error {
+	t.mu.RLock()
+	peers := t.peers
+	t.mu.RUnlock()
+
+	var mu sync.Mutex
+	var errs MultiError
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			gpp := &GPP{
+				Uri:     peer,
+				Timeout: t.Timeout,
+				Params:  e,
+			}
+			if t.Secret != "" {
+				gpp.Headers = map[string]string{HTTPTransportSecretHeader: t.Secret}
+			}
+			_, err := Post(gpp)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("peer %s: %v", peer, err))
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return errs.ErrorOrNil()
+}
+
+func (t *HTTPTransport) Start(recv func(*Event)) error {
+	t.mu.Lock()
+	t.recv = recv
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *HTTPTransport) Close() error {
+	t.mu.Lock()
+	t.recv = nil
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.RLock()
+	recv := t.recv
+	t.mu.RUnlock()
+
+	if t.Secret != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(HTTPTransportSecretHeader)), []byte(t.Secret)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else if !isInnerRemote(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	maxSize := t.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+	e := &Event{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSize)).Decode(e); err != nil || e.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if recv == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	recv(e)
+}
+
+// UnixTransport 同一台机器上的多个实例通过dir目录下的unixgram socket广播事件，
+// 单个事件序列化后不能超过系统对datagram大小的限制
+type UnixTransport struct {
+	dir  string
+	path string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func NewUnixTransport(dir string) *UnixTransport {
+	return &UnixTransport{
+		dir:  dir,
+		path: filepath.Join(dir, fmt.Sprintf("%d-%d.sock", os.Getpid(), atomic.AddInt64(&eventSeq, 1))),
+	}
+}
+
+func (t *UnixTransport) Start(recv func(*Event)) (err error) {
+	if err = os.MkdirAll(t.dir, 0755); err != nil {
+		return
+	}
+	os.Remove(t.path)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: t.path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+
+	go func() {
+		buf := make([]byte, 1<<20)
+		for {
+			n, _, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					GetLogger().Error("utils.UnixTransport read error", "path", t.path, "err", err)
+				}
+				return
+			}
+
+			e := &Event{}
+			if err := json.Unmarshal(buf[:n], e); err != nil {
+				GetLogger().Warn("utils.UnixTransport bad event", "path", t.path, "err", err)
+				continue
+			}
+			recv(e)
+		}
+	}()
+	return
+}
+
+func (t *UnixTransport) Send(e *Event) (err error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn == nil {
+		return errors.New("unix transport not started")
+	}
+
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(t.dir, "*.sock"))
+	if err != nil {
+		return
+	}
+
+	var errs MultiError
+	for _, path := range paths {
+		if path == t.path {
+			continue
+		}
+		_, err := conn.WriteToUnix(bs, &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err == nil {
+			continue
+		}
+		// 对应的实例已退出
+		if errors.Is(err, syscall.ECONNREFUSED) || os.IsNotExist(err) {
+			os.Remove(path)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("peer %s: %v", path, err))
+	}
+	return errs.ErrorOrNil()
+}
+
+func (t *UnixTransport) Close() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return
+	}
+	err = t.conn.Close()
+	t.conn = nil
+	os.Remove(t.path)
+	return
+}
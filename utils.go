@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"net"
 	"net/http"
@@ -60,7 +59,7 @@ func IsInnerIp(src_ip string) bool {
 var LocalIp = func() string {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Println("utils.LocalIp error:", err)
+		GetLogger().Error("utils.LocalIp error", "err", err)
 		return ""
 	}
 	for _, iface := range ifaces {
@@ -72,7 +71,7 @@ var LocalIp = func() string {
 		}
 		addrs, err := iface.Addrs()
 		if err != nil {
-			log.Println("utils.LocalIp error:", err)
+			GetLogger().Error("utils.LocalIp error", "err", err)
 			return ""
 		}
 		for _, addr := range addrs {
@@ -95,7 +94,7 @@ var LocalIp = func() string {
 			}
 		}
 	}
-	log.Println("utils.LocalIp failed!")
+	GetLogger().Warn("utils.LocalIp failed!")
 	return ""
 }()
 
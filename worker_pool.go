@@ -0,0 +1,295 @@
+// 此文件定义有界worker pool，任务计入异步任务数，AsyncTaskShutdown时停止接收新任务并处理完队列
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolPolicy 队列满时的处理策略
+type PoolPolicy int
+
+const (
+	// PolicyReject 直接拒绝，Submit返回ErrPoolFull
+	PolicyReject PoolPolicy = iota
+	// PolicyBlock 阻塞直到队列有空位
+	PolicyBlock
+	// PolicyDropOldest 丢弃队列里最早的任务
+	PolicyDropOldest
+)
+
+var (
+	ErrPoolFull   = errors.New("worker pool full")
+	ErrPoolClosed = errors.New("worker pool closed")
+)
+
+// WorkerPoolConf worker pool配置
+type WorkerPoolConf struct {
+	Name        string        // 用于日志及AsyncTaskRunning
+	MinWorkers  int           // 常驻worker数，<=0时为1
+	MaxWorkers  int           // 最大worker数，大于MinWorkers时按需扩容
+	IdleTimeout time.Duration // 扩容出的worker空闲多久后退出，<=0时为1分钟
+	QueueSize   int           // 队列长度
+	Policy      PoolPolicy    // 队列满时的处理策略
+	TaskTimeout time.Duration // 单个任务超时，通过ctx通知任务，<=0表示不限制
+}
+
+// WorkerPoolStats worker pool运行指标
+type WorkerPoolStats struct {
+	Queued   int   `json:"queued"`
+	Running  int   `json:"running"`
+	Workers  int   `json:"workers"`
+	Rejected int64 `json:"rejected"`
+	Dropped  int64 `json:"dropped"`
+	Done     int64 `json:"done"`
+	Failed   int64 `json:"failed"`
+}
+
+type poolTask func(ctx context.Context) error
+
+type WorkerPool struct {
+	conf WorkerPoolConf
+
+	queue   chan poolTask
+	closing chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+	mu      sync.RWMutex
+	wg      sync.WaitGroup
+
+	closed   int32
+	workers  int32
+	idle     int32
+	running  int32
+	rejected int64
+	dropped  int64
+	done     int64
+	failed   int64
+}
+
+// NewWorkerPool 创建并启动worker pool，AsyncTaskShutdown时会自动Close
+func NewWorkerPool(conf *WorkerPoolConf) *WorkerPool {
+	c := *conf
+	if c.Name == "" {
+		c.Name = "worker_pool"
+	}
+	if c.MinWorkers <= 0 {
+		c.MinWorkers = 1
+	}
+	if c.MaxWorkers < c.MinWorkers {
+		c.MaxWorkers = c.MinWorkers
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = time.Minute
+	}
+	if c.QueueSize < 0 {
+		c.QueueSize = 0
+	}
+
+	p := &WorkerPool{
+		conf:    c,
+		queue:   make(chan poolTask, c.QueueSize),
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < c.MinWorkers; i++ {
+		p.spawn(false)
+	}
+
+	go func() {
+		select {
+		case <-AsyncTaskChan:
+			p.Close()
+		case <-p.closing:
+		}
+	}()
+
+	return p
+}
+
+// Submit 提交任务，队列满时按Policy处理
+func (p *WorkerPool) Submit(f func(ctx context.Context) error) (err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return ErrPoolClosed
+	}
+
+	asyncTaskEnterNamed(p.conf.Name)
+
+	// 没有空闲worker时扩容，任务直接交给新worker，新worker此时还没有从队列接收
+	if atomic.LoadInt32(&p.idle) == 0 && p.trySpawn(f) {
+		return
+	}
+
+	switch {
+	case p.conf.Policy == PolicyBlock:
+		select {
+		case p.queue <- f:
+		case <-p.closing:
+			err = ErrPoolClosed
+		}
+	case p.conf.Policy == PolicyDropOldest && p.conf.QueueSize > 0:
+		for sent := false; !sent; {
+			select {
+			case p.queue <- f:
+				sent = true
+			default:
+				select {
+				case <-p.queue:
+					atomic.AddInt64(&p.dropped, 1)
+					asyncTaskExitNamed(p.conf.Name)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case p.queue <- f:
+		default:
+			atomic.AddInt64(&p.rejected, 1)
+			err = ErrPoolFull
+		}
+	}
+
+	if err != nil {
+		asyncTaskExitNamed(p.conf.Name)
+	}
+	return
+}
+
+// trySpawn 未达到MaxWorkers时启动新worker先执行f，返回是否已启动
+func (p *WorkerPool) trySpawn(f poolTask) bool {
+	for {
+		n := atomic.LoadInt32(&p.workers)
+		if int(n) >= p.conf.MaxWorkers {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.workers, n, n+1) {
+			p.wg.Add(1)
+			go p.work(true, f)
+			return true
+		}
+	}
+}
+
+func (p *WorkerPool) spawn(elastic bool) {
+	atomic.AddInt32(&p.workers, 1)
+	p.wg.Add(1)
+	go p.work(elastic, nil)
+}
+
+// work first不为空时先执行first，再从队列接收任务
+func (p *WorkerPool) work(elastic bool, first poolTask) {
+	defer func() {
+		atomic.AddInt32(&p.workers, -1)
+		p.wg.Done()
+	}()
+
+	if first != nil {
+		p.run(first)
+	}
+
+	var timer *time.Timer
+	var idleC <-chan time.Time
+	if elastic {
+		timer = time.NewTimer(p.conf.IdleTimeout)
+		defer timer.Stop()
+		idleC = timer.C
+	}
+
+	for {
+		atomic.AddInt32(&p.idle, 1)
+		select {
+		case f := <-p.queue:
+			atomic.AddInt32(&p.idle, -1)
+			p.run(f)
+			if elastic {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(p.conf.IdleTimeout)
+			}
+		case <-p.stop:
+			atomic.AddInt32(&p.idle, -1)
+			for {
+				select {
+				case f := <-p.queue:
+					p.run(f)
+				default:
+					return
+				}
+			}
+		case <-idleC:
+			atomic.AddInt32(&p.idle, -1)
+			return
+		}
+	}
+}
+
+func (p *WorkerPool) run(f poolTask) {
+	atomic.AddInt32(&p.running, 1)
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout := p.conf.TaskTimeout; timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.failed, 1)
+			GetLogger().Error("utils.WorkerPool recover", "name", p.conf.Name, "err", r, "stack", string(debug.Stack()))
+		}
+		cancel()
+		atomic.AddInt32(&p.running, -1)
+		asyncTaskExitNamed(p.conf.Name)
+	}()
+
+	if err := f(ctx); err != nil {
+		atomic.AddInt64(&p.failed, 1)
+		GetLogger().Warn("utils.WorkerPool task error", "name", p.conf.Name, "err", err)
+		return
+	}
+	atomic.AddInt64(&p.done, 1)
+}
+
+// Close 停止接收新任务，已入队的任务会继续执行完
+func (p *WorkerPool) Close() {
+	p.once.Do(func() {
+		atomic.StoreInt32(&p.closed, 1)
+		close(p.closing)
+		p.mu.Lock()
+		close(p.stop)
+		p.mu.Unlock()
+	})
+}
+
+// Wait 等待Close后所有worker退出
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
+
+// Stats 返回运行指标
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Queued:   len(p.queue),
+		Running:  int(atomic.LoadInt32(&p.running)),
+		Workers:  int(atomic.LoadInt32(&p.workers)),
+		Rejected: atomic.LoadInt64(&p.rejected),
+		Dropped:  atomic.LoadInt64(&p.dropped),
+		Done:     atomic.LoadInt64(&p.done),
+		Failed:   atomic.LoadInt64(&p.failed),
+	}
+}
+
+func (s WorkerPoolStats) String() string {
+	return fmt.Sprintf("queued: %d, running: %d, workers: %d, rejected: %d, dropped: %d, done: %d, failed: %d",
+		s.Queued, s.Running, s.Workers, s.Rejected, s.Dropped, s.Done, s.Failed)
+}
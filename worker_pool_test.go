@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("wait timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	for _, policy := range []PoolPolicy{PolicyReject, PolicyDropOldest} {
+		p := NewWorkerPool(&WorkerPoolConf{QueueSize: 1, Policy: policy})
+
+		block := make(chan struct{})
+		ran := make(chan int, 3)
+		task := func(i int) func(context.Context) error {
+			return func(context.Context) error {
+				<-block
+				ran <- i
+				return nil
+			}
+		}
+
+		if err := p.Submit(task(1)); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return p.Stats().Running == 1 })
+		if err := p.Submit(task(2)); err != nil {
+			t.Fatal(err)
+		}
+
+		err := p.Submit(task(3))
+		switch policy {
+		case PolicyReject:
+			if err != ErrPoolFull || p.Stats().Rejected != 1 {
+				t.Fatalf("reject policy err: %v, stats: %v", err, p.Stats())
+			}
+		case PolicyDropOldest:
+			if err != nil || p.Stats().Dropped != 1 {
+				t.Fatalf("drop oldest policy err: %v, stats: %v", err, p.Stats())
+			}
+		}
+
+		close(block)
+		p.Close()
+		p.Wait()
+		close(ran)
+
+		var got []int
+		for i := range ran {
+			got = append(got, i)
+		}
+		want := 2
+		if policy == PolicyDropOldest {
+			want = 3
+		}
+		if len(got) != 2 || got[1] != want {
+			t.Fatalf("policy %d ran: %v", policy, got)
+		}
+		if err := p.Submit(task(4)); err != ErrPoolClosed {
+			t.Fatalf("submit after close err: %v", err)
+		}
+	}
+}
+
+func TestWorkerPoolBlock(t *testing.T) {
+	p := NewWorkerPool(&WorkerPoolConf{Policy: PolicyBlock})
+	defer p.Close()
+
+	block := make(chan struct{})
+	if err := p.Submit(func(context.Context) error { <-block; return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- p.Submit(func(context.Context) error { return nil })
+	}()
+	select {
+	case err := <-submitted:
+		t.Fatalf("submit should block: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(block)
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return p.Stats().Done == 2 })
+}
+
+func TestWorkerPoolElastic(t *testing.T) {
+	p := NewWorkerPool(&WorkerPoolConf{MinWorkers: 1, MaxWorkers: 4, IdleTimeout: time.Millisecond * 50})
+	defer p.Close()
+
+	// 没有队列时扩容出的worker直接执行任务
+	block := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		if err := p.Submit(func(context.Context) error { <-block; return nil }); err != nil {
+			t.Fatalf("task %d: %v", i, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	waitFor(t, func() bool { return p.Stats().Running == 4 })
+	if n := p.Stats().Workers; n != 4 {
+		t.Fatalf("workers: %d", n)
+	}
+	if err := p.Submit(func(context.Context) error { return nil }); err != ErrPoolFull {
+		t.Fatalf("submit beyond max workers: %v", err)
+	}
+
+	// 空闲后缩容到MinWorkers
+	close(block)
+	waitFor(t, func() bool { return p.Stats().Workers == 1 })
+}
+
+func TestWorkerPoolTaskTimeout(t *testing.T) {
+	p := NewWorkerPool(&WorkerPoolConf{QueueSize: 1, TaskTimeout: time.Millisecond * 20})
+	defer p.Close()
+
+	errC := make(chan error, 1)
+	if err := p.Submit(func(ctx context.Context) error {
+		<-ctx.Done()
+		errC <- ctx.Err()
+		return ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errC:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("ctx err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("task ctx not canceled")
+	}
+	waitFor(t, func() bool { return p.Stats().Failed == 1 })
+}
+
+func TestWorkerPoolPanic(t *testing.T) {
+	p := NewWorkerPool(&WorkerPoolConf{QueueSize: 1})
+	defer p.Close()
+
+	if err := p.Submit(func(context.Context) error { panic("oops") }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return p.Stats().Failed == 1 })
+
+	// worker在panic后继续处理任务
+	done := make(chan bool)
+	if err := p.Submit(func(context.Context) error { close(done); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker died after panic")
+	}
+	if n := p.Stats().Workers; n != 1 {
+		t.Fatalf("workers: %d", n)
+	}
+}